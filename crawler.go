@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"path"
 	"strings"
 	"time"
 
@@ -20,7 +22,37 @@ type Pokemon struct {
 	Types        []string          `json:"types"`
 	Stats        map[string]string `json:"stats"`
 	EXP          string            `json:"exp"`
+	CatchRate    string            `json:"catch_rate"`
 	WhenAttacked map[string]string `json:"when_attacked"`
+	Evolutions   []Evolution       `json:"evolutions,omitempty"`
+}
+
+// Evolution is one way a species evolves into another
+type Evolution struct {
+	To      string `json:"to"`              // Pokédex ID of the evolved species
+	Trigger string `json:"trigger"`         // "level", "item" or "trade"
+	Level   int    `json:"level,omitempty"` // Level trigger: the level it evolves at
+	Item    string `json:"item,omitempty"`  // Item trigger: the item used; trade trigger: the item held, if any
+}
+
+// ChainLink is one species in a PokeAPI evolution chain, with the species it evolves into
+type ChainLink struct {
+	Species struct {
+		URL string `json:"url"`
+	} `json:"species"`
+	EvolutionDetails []struct {
+		Trigger struct {
+			Name string `json:"name"`
+		} `json:"trigger"`
+		MinLevel int `json:"min_level"`
+		Item     *struct {
+			Name string `json:"name"`
+		} `json:"item"`
+		HeldItem *struct {
+			Name string `json:"name"`
+		} `json:"held_item"`
+	} `json:"evolution_details"`
+	EvolvesTo []ChainLink `json:"evolves_to"`
 }
 
 func main() {
@@ -95,6 +127,37 @@ func main() {
 		}
 	}
 
+	// Step 3b: Scrape catch rates from Bulbapedia
+	catchCollector := colly.NewCollector(
+		colly.AllowedDomains("bulbapedia.bulbagarden.net"),
+	)
+
+	// Create a map to hold catch rates by Pokémon ID
+	catchRateMap := make(map[string]string)
+
+	// The catch rate table lists the national ID first and the catch rate last
+	catchCollector.OnHTML("table.sortable tbody tr", func(e *colly.HTMLElement) {
+		id := strings.TrimLeft(strings.Trim(e.ChildText("td:nth-child(1)"), "\n #"), "0")
+		rate := strings.Trim(e.ChildText("td:last-child"), "\n ")
+
+		// Keep the first entry per ID so alternate forms don't overwrite it
+		if _, seen := catchRateMap[id]; id != "" && rate != "" && !seen {
+			catchRateMap[id] = rate
+		}
+	})
+
+	catchCollector.OnError(func(_ *colly.Response, err error) {
+		log.Println("Error:", err)
+	})
+
+	catchCollector.Visit("https://bulbapedia.bulbagarden.net/wiki/List_of_Pok%C3%A9mon_by_catch_rate")
+
+	for i := range pokemons {
+		if rate, found := catchRateMap[pokemons[i].ID]; found {
+			pokemons[i].CatchRate = rate
+		}
+	}
+
 	// Step 4: Scrape "When Attacked" data from Pokedex.org using chromedp
 	basePokedexURL := "https://pokedex.org/#/pokemon/"
 	for i := range pokemons {
@@ -134,6 +197,45 @@ func main() {
 		fmt.Printf("Fetched When Attacked data for %s\n", pokemons[i].Name)
 	}
 
+	// Step 4b: Fetch evolution chains from PokeAPI, keeping evolutions between crawled species
+	crawled := make(map[string]bool)
+	for i := range pokemons {
+		crawled[pokemons[i].ID] = true
+	}
+	evolutions := make(map[string][]Evolution)
+	fetchedChains := make(map[string]bool)
+	for i := range pokemons {
+		var species struct {
+			EvolutionChain struct {
+				URL string `json:"url"`
+			} `json:"evolution_chain"`
+		}
+		if err := fetchJSON(fmt.Sprintf("https://pokeapi.co/api/v2/pokemon-species/%s/", pokemons[i].ID), &species); err != nil {
+			log.Printf("Failed to fetch species data for %s: %v", pokemons[i].Name, err)
+			continue
+		}
+
+		// Every species in a family shares one chain
+		chainURL := species.EvolutionChain.URL
+		if chainURL == "" || fetchedChains[chainURL] {
+			continue
+		}
+		fetchedChains[chainURL] = true
+		var chain struct {
+			Chain ChainLink `json:"chain"`
+		}
+		if err := fetchJSON(chainURL, &chain); err != nil {
+			log.Printf("Failed to fetch evolution chain for %s: %v", pokemons[i].Name, err)
+			continue
+		}
+		collectEvolutions(chain.Chain, crawled, evolutions)
+		fmt.Printf("Fetched evolution chain for %s\n", pokemons[i].Name)
+	}
+
+	for i := range pokemons {
+		pokemons[i].Evolutions = evolutions[pokemons[i].ID]
+	}
+
 	// Step 5: Save the merged Pokémon data to a JSON file
 	file, err := os.Create("pokedex.json")
 	fmt.Println("Saving Pokedex data to pokedex.json...")
@@ -150,3 +252,56 @@ func main() {
 
 	fmt.Println("Pokedex data successfully saved to pokedex.json!")
 }
+
+// fetchJSON decodes the JSON document at a URL
+func fetchJSON(url string, v interface{}) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// itemKey turns a PokeAPI item name such as "thunder-stone" into the key items.json and shop.json use
+func itemKey(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// collectEvolutions walks an evolution chain, recording the level, item and trade evolutions between crawled species.
+// Other triggers, such as friendship, have no equivalent in the games and are skipped.
+func collectEvolutions(link ChainLink, crawled map[string]bool, evolutions map[string][]Evolution) {
+	from := path.Base(strings.TrimSuffix(link.Species.URL, "/"))
+	for _, next := range link.EvolvesTo {
+		to := path.Base(strings.TrimSuffix(next.Species.URL, "/"))
+		if crawled[from] && crawled[to] {
+			found := false
+			for _, detail := range next.EvolutionDetails {
+				evolution := Evolution{To: to}
+				switch {
+				case detail.Trigger.Name == "level-up" && detail.MinLevel > 0:
+					evolution.Trigger, evolution.Level = "level", detail.MinLevel
+				case detail.Trigger.Name == "use-item" && detail.Item != nil:
+					evolution.Trigger, evolution.Item = "item", itemKey(detail.Item.Name)
+				case detail.Trigger.Name == "trade":
+					evolution.Trigger = "trade"
+					if detail.HeldItem != nil {
+						evolution.Item = itemKey(detail.HeldItem.Name)
+					}
+				default:
+					continue
+				}
+				evolutions[from] = append(evolutions[from], evolution)
+				found = true
+				break
+			}
+			if !found {
+				log.Printf("Skipping evolution from #%s to #%s: no level, item or trade trigger", from, to)
+			}
+		}
+		collectEvolutions(next, crawled, evolutions)
+	}
+}
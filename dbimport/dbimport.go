@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"projec/store"
+)
+
+// dbimport copies accounts.json and player_data.json into an SQLite database, which the hub, Pokecat
+// and Pokebat use instead of the files when started with -db. It can be run again: accounts and players
+// in the files replace the ones with the same name, and anyone only in the database is kept.
+func main() {
+	accountsFile := flag.String("accounts", store.DataPath("accounts.json"), "accounts to import")
+	playersFile := flag.String("players", store.DataPath("player_data.json"), "saved players to import")
+	dbFile := flag.String("db", store.DataPath("pokemon.db"), "database to import into, created if missing")
+	flag.Parse()
+
+	if err := store.RequireFiles(*accountsFile, *playersFile); err != nil {
+		log.Fatal(err)
+	}
+	db, err := store.OpenSQL(*dbFile)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	accounts, err := store.OpenAccounts(*accountsFile).List()
+	if err != nil {
+		log.Fatalf("Failed to load accounts: %v", err)
+	}
+	imported, err := store.OpenFile(*playersFile).Load()
+	if err != nil {
+		log.Fatalf("Failed to load players: %v", err)
+	}
+	if err := db.Import(accounts, imported); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Imported %d accounts and %d players into %s", len(accounts), len(imported), *dbFile)
+}
@@ -1,20 +1,134 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	crand "crypto/rand"
+	"encoding/hex"
 	"log"
+	"math"
 	"bufio"
 	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"projec/store"
+)
+
+// HeldItem is an item from items.json that a Pokémon can hold in battle
+type HeldItem struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// DexEntry is what a player's Pokédex records about one species; Pokecat writes it as they play
+type DexEntry struct {
+	Caught      bool   `json:"caught"`
+	FirstSeen   string `json:"first_seen,omitempty"`
+	FirstCaught string `json:"first_caught,omitempty"`
+}
+
+// Species is a pokedex.json entry
+type Species struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Types        []string          `json:"types"`
+	Stats        map[string]string `json:"stats"`
+	Exp          string            `json:"exp"`
+	WhenAttacked map[string]string `json:"when_attacked"`
+	Evolutions   []Evolution       `json:"evolutions"`
+}
+
+// Evolution is one way a species evolves into another
+type Evolution struct {
+	To      string `json:"to"`      // Pokédex ID of the evolved species
+	Trigger string `json:"trigger"` // "level", "item" or "trade"
+	Level   int    `json:"level"`
+	Item    string `json:"item"`
+}
+
+// Longest nickname a Pokémon can be given
+const maxNicknameLength = 12
+
+// Where every player's Pokémon, team presets, Pokédex, money and items are saved, and the accounts
+// they log in with; opened in main
+var (
+	playerStore store.Store
+	accounts    store.Accounts
+)
+
+// Trade holds an offer of one player's Pokémon to another, kept in trades.json until it is answered
+type Trade struct {
+	ID        string `json:"id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Offered   string `json:"offered"`   // Instance ID of the Pokémon From gives
+	Requested string `json:"requested"` // Instance ID of the Pokémon To gives, or "" for a gift
+	Status    string `json:"status"`    // "pending", "countered", "completed", "declined", "cancelled" or "failed"
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// TradeEvent is one line of the append-only trade audit log
+type TradeEvent struct {
+	Time      string         `json:"time"`
+	TradeID   string         `json:"trade_id"`
+	Event     string         `json:"event"` // "offered", "countered", "completed", "declined", "cancelled" or "failed"
+	By        string         `json:"by"`
+	From      string         `json:"from"`
+	To        string         `json:"to"`
+	Offered   *TradedPokemon `json:"offered,omitempty"`
+	Requested *TradedPokemon `json:"requested,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+}
+
+// TradedPokemon records which Pokémon a trade moved, as it was when the event happened
+type TradedPokemon struct {
+	InstanceID  string `json:"instance_id"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Nickname    string `json:"nickname,omitempty"`
+	EvolvedInto string `json:"evolved_into,omitempty"` // Species it became by trade evolution
+}
+
+// Where trades and their audit log are kept, next to player_data.json
+var (
+	tradesFile   = store.DataPath("trades.json")
+	tradeLogFile = store.DataPath("trade_log.jsonl")
 )
 
-type Account struct{
-	Username string `json:"Name"`
-	Password string `json:"Password"`
+// Most of one item that can be bought at once
+const maxPurchase = 99
+
+// TeamPreset is a named Pokebat team saved in a player's profile
+type TeamPreset struct {
+	Name       string   `json:"name"`
+	PokemonIDs []string `json:"pokemon_ids"`
 }
 
 func main() {
+	playersFile := flag.String("players", store.DataPath("player_data.json"), "path to the saved player data shared with Pokecat and Pokebat")
+	accountsFile := flag.String("accounts", store.DataPath("accounts.json"), "path to the accounts players log in with")
+	dbFile := flag.String("db", "", "SQLite database to use instead of the accounts and player data files, filled by dbimport")
+	flag.Parse()
+	playerStore, accounts = store.OpenFile(*playersFile), store.OpenAccounts(*accountsFile)
+	if *dbFile == "" {
+		if err := store.RequireFiles(*playersFile, *accountsFile); err != nil {
+			log.Fatalf("Failed to open player data: %v", err)
+		}
+	} else {
+		db, err := store.OpenSQL(*dbFile)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.Close()
+		playerStore, accounts = db, db
+	}
+
 	for {
 		fmt.Println("Welcome to the Game Hub!")
 		fmt.Println("Please choose a game to play:")
@@ -22,6 +136,13 @@ func main() {
 		fmt.Println("2. Pokebat")
 		fmt.Println("3. Exit")
 		fmt.Println("4. Create a new account")
+		fmt.Println("5. Manage team presets")
+		fmt.Println("6. Manage held items")
+		fmt.Println("7. View Pokédex progress")
+		fmt.Println("8. Nickname your Pokémon")
+		fmt.Println("9. Evolve a Pokémon with an item")
+		fmt.Println("10. Trade Pokémon")
+		fmt.Println("11. Shop")
 		fmt.Print("Enter your choice: ")
 
 		var choice int
@@ -46,6 +167,7 @@ func main() {
 		case 2:
 			fmt.Println("Launching Pokebat...")
 			cmd := exec.Command("go", "run", "pokebat/clients.go")
+			cmd.Stdin = os.Stdin
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
 
@@ -56,6 +178,20 @@ func main() {
 		case 3:
 			fmt.Println("Exiting the Game Hub. Goodbye!")
 			os.Exit(0)
+		case 5:
+			manageTeams()
+		case 6:
+			manageHeldItems()
+		case 7:
+			showPokedex()
+		case 8:
+			manageNicknames()
+		case 9:
+			evolveWithItem()
+		case 10:
+			manageTrades()
+		case 11:
+			visitShop()
 		
 		
 		default:
@@ -63,3 +199,1405 @@ func main() {
 		}
 	}
 }
+
+
+// manageTeams lets a logged-in player list, create and delete team presets
+func manageTeams() {
+	reader := bufio.NewReader(os.Stdin)
+	username, ok := login(reader)
+	if !ok {
+		fmt.Println("Invalid username or password.")
+		return
+	}
+
+	for {
+		record, err := loadPlayerRecord(playerStore, username)
+		if err != nil {
+			fmt.Printf("Failed to load your player data: %v\n", err)
+			return
+		}
+		roster := rosterOf(record)
+		teams := teamsOf(record)
+
+		fmt.Println("\nYour team presets:")
+		if len(teams) == 0 {
+			fmt.Println("  (none)")
+		}
+		for i, team := range teams {
+			fmt.Printf("  %d. %s: %s\n", i+1, team.Name, describeTeam(team, roster))
+		}
+		fmt.Println("1. Create a team")
+		fmt.Println("2. Delete a team")
+		fmt.Println("3. Back")
+		fmt.Print("Enter your choice: ")
+
+		switch readLine(reader) {
+		case "1":
+			team, ok := createTeam(reader, roster, teams)
+			if !ok {
+				continue
+			}
+			teams = append(teams, team)
+		case "2":
+			fmt.Print("Enter the number of the team to delete: ")
+			var index int
+			if _, err := fmt.Sscan(readLine(reader), &index); err != nil || index < 1 || index > len(teams) {
+				fmt.Println("Invalid team number.")
+				continue
+			}
+			teams = append(teams[:index-1], teams[index:]...)
+		case "3":
+			return
+		default:
+			fmt.Println("Invalid choice. Please choose a valid option.")
+			continue
+		}
+
+		if err := saveTeams(playerStore, username, teams); err != nil {
+			fmt.Printf("Failed to save your teams: %v\n", err)
+			return
+		}
+		fmt.Println("Teams saved.")
+	}
+}
+
+// manageHeldItems lets a logged-in player give or take held items from their Pokémon
+func manageHeldItems() {
+	reader := bufio.NewReader(os.Stdin)
+	username, ok := login(reader)
+	if !ok {
+		fmt.Println("Invalid username or password.")
+		return
+	}
+
+	file, err := os.ReadFile(store.DataPath("items.json"))
+	if err != nil {
+		fmt.Printf("Failed to load items: %v\n", err)
+		return
+	}
+	var items map[string]HeldItem
+	if err := json.Unmarshal(file, &items); err != nil {
+		fmt.Printf("Failed to parse items: %v\n", err)
+		return
+	}
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for {
+		record, err := loadPlayerRecord(playerStore, username)
+		if err != nil {
+			fmt.Printf("Failed to load your player data: %v\n", err)
+			return
+		}
+		roster := rosterOf(record)
+
+		fmt.Println("\nYour Pokémon:")
+		for i, pokemon := range roster {
+			held := "nothing"
+			if item, ok := items[fmt.Sprint(pokemon["held_item"])]; ok {
+				held = item.Name
+			}
+			fmt.Printf("  %d. %s (holding %s)\n", i+1, describePokemon(pokemon), held)
+		}
+		fmt.Print("Enter the number of a Pokémon to change its item, or press Enter to go back: ")
+		line := readLine(reader)
+		if line == "" {
+			return
+		}
+		index, err := strconv.Atoi(line)
+		if err != nil || index < 1 || index > len(roster) {
+			fmt.Println("Invalid Pokémon number.")
+			continue
+		}
+
+		fmt.Println("Items:")
+		fmt.Println("  0. Nothing")
+		for i, key := range keys {
+			fmt.Printf("  %d. %s - %s\n", i+1, items[key].Name, items[key].Description)
+		}
+		fmt.Print("Enter the number of the item to hold: ")
+		choice, err := strconv.Atoi(readLine(reader))
+		if err != nil || choice < 0 || choice > len(keys) {
+			fmt.Println("Invalid item number.")
+			continue
+		}
+
+		heldItem := ""
+		if choice > 0 {
+			heldItem = keys[choice-1]
+		}
+		if err := saveHeldItem(playerStore, username, instanceID(roster[index-1]), heldItem); err != nil {
+			fmt.Printf("Failed to save the held item: %v\n", err)
+			return
+		}
+		fmt.Println("Held item saved.")
+	}
+}
+
+// manageNicknames lets a logged-in player name or rename their Pokémon
+func manageNicknames() {
+	reader := bufio.NewReader(os.Stdin)
+	username, ok := login(reader)
+	if !ok {
+		fmt.Println("Invalid username or password.")
+		return
+	}
+
+	for {
+		record, err := loadPlayerRecord(playerStore, username)
+		if err != nil {
+			fmt.Printf("Failed to load your player data: %v\n", err)
+			return
+		}
+		roster := rosterOf(record)
+
+		fmt.Println("\nYour Pokémon:")
+		for i, pokemon := range roster {
+			fmt.Printf("  %d. %s\n", i+1, describePokemon(pokemon))
+		}
+		fmt.Print("Enter the number of a Pokémon to nickname, or press Enter to go back: ")
+		line := readLine(reader)
+		if line == "" {
+			return
+		}
+		index, err := strconv.Atoi(line)
+		if err != nil || index < 1 || index > len(roster) {
+			fmt.Println("Invalid Pokémon number.")
+			continue
+		}
+
+		fmt.Print("Enter a nickname, or press Enter to clear it: ")
+		nickname := readLine(reader)
+		if len([]rune(nickname)) > maxNicknameLength {
+			fmt.Printf("Nicknames can be at most %d characters.\n", maxNicknameLength)
+			continue
+		}
+		if err := saveNickname(playerStore, username, instanceID(roster[index-1]), nickname); err != nil {
+			fmt.Printf("Failed to save the nickname: %v\n", err)
+			return
+		}
+		fmt.Println("Nickname saved.")
+	}
+}
+
+// evolveWithItem lets a logged-in player use an evolution item such as a Fire Stone on one of their Pokémon
+func evolveWithItem() {
+	reader := bufio.NewReader(os.Stdin)
+	username, ok := login(reader)
+	if !ok {
+		fmt.Println("Invalid username or password.")
+		return
+	}
+	species, err := loadSpecies(store.DataPath("pokedex.json"))
+	if err != nil {
+		fmt.Printf("Failed to load Pokédex: %v\n", err)
+		return
+	}
+
+	record, err := loadPlayerRecord(playerStore, username)
+	if err != nil {
+		fmt.Printf("Failed to load your player data: %v\n", err)
+		return
+	}
+	roster := rosterOf(record)
+	var candidates []int
+	fmt.Println("\nPokémon that evolve with an item:")
+	for i, pokemon := range roster {
+		if from := findSpecies(species, fmt.Sprint(pokemon["id"])); from != nil && len(itemEvolutions(*from)) > 0 {
+			candidates = append(candidates, i)
+			fmt.Printf("  %d. %s\n", len(candidates), describePokemon(pokemon))
+		}
+	}
+	if len(candidates) == 0 {
+		fmt.Println("  (none)")
+		return
+	}
+	fmt.Print("Enter the number of a Pokémon, or press Enter to go back: ")
+	choice, err := strconv.Atoi(readLine(reader))
+	if err != nil || choice < 1 || choice > len(candidates) {
+		fmt.Println("Invalid Pokémon number.")
+		return
+	}
+	index := candidates[choice-1]
+	from := findSpecies(species, fmt.Sprint(roster[index]["id"]))
+
+	shop, err := store.LoadShop(store.DataPath("shop.json"))
+	if err != nil {
+		fmt.Printf("Failed to load the shop: %v\n", err)
+		return
+	}
+	_, inventory, err := shop.WalletOf(record)
+	if err != nil {
+		fmt.Printf("Failed to load your items: %v\n", err)
+		return
+	}
+	evolutions := itemEvolutions(*from)
+	fmt.Println("Items:")
+	for i, evolution := range evolutions {
+		fmt.Printf("  %d. %s (evolves into %s, you have %d)\n", i+1, itemName(evolution.Item),
+			findSpecies(species, evolution.To).Name, inventory[evolution.Item])
+	}
+	fmt.Print("Enter the number of the item to use: ")
+	choice, err = strconv.Atoi(readLine(reader))
+	if err != nil || choice < 1 || choice > len(evolutions) {
+		fmt.Println("Invalid item number.")
+		return
+	}
+	to := findSpecies(species, evolutions[choice-1].To)
+
+	if err := saveEvolution(playerStore, username, instanceID(roster[index]), evolutions[choice-1].Item, *to, species, shop); err != nil {
+		fmt.Printf("Failed to save the evolution: %v\n", err)
+		return
+	}
+	fmt.Printf("What? %s evolved into %s!\n", from.Name, to.Name)
+}
+
+// visitShop lets a logged-in player spend their money on balls, potions and evolution stones
+func visitShop() {
+	reader := bufio.NewReader(os.Stdin)
+	username, ok := login(reader)
+	if !ok {
+		fmt.Println("Invalid username or password.")
+		return
+	}
+	shop, err := store.LoadShop(store.DataPath("shop.json"))
+	if err != nil {
+		fmt.Printf("Failed to load the shop: %v\n", err)
+		return
+	}
+	keys := make([]string, 0, len(shop.Items))
+	for key := range shop.Items {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := shop.Items[keys[i]], shop.Items[keys[j]]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Price != b.Price {
+			return a.Price < b.Price
+		}
+		return a.Name < b.Name
+	})
+
+	for {
+		record, err := loadPlayerRecord(playerStore, username)
+		if err != nil {
+			fmt.Printf("Failed to load your player data: %v\n", err)
+			return
+		}
+		money, inventory, err := shop.WalletOf(record)
+		if err != nil {
+			fmt.Printf("Failed to load your items: %v\n", err)
+			return
+		}
+
+		fmt.Printf("\nYou have ₽%d.\n", money)
+		fmt.Println("For sale:")
+		for i, key := range keys {
+			item := shop.Items[key]
+			fmt.Printf("  %d. %-14s ₽%-5d (you have %d) - %s\n", i+1, item.Name, item.Price, inventory[key], item.Description)
+		}
+		fmt.Print("Enter the number of an item to buy, or press Enter to go back: ")
+		line := readLine(reader)
+		if line == "" {
+			return
+		}
+		choice, err := strconv.Atoi(line)
+		if err != nil || choice < 1 || choice > len(keys) {
+			fmt.Println("Invalid item number.")
+			continue
+		}
+		key := keys[choice-1]
+
+		fmt.Print("How many? ")
+		count, err := strconv.Atoi(readLine(reader))
+		if err != nil || count < 1 || count > maxPurchase {
+			fmt.Printf("Enter a number from 1 to %d.\n", maxPurchase)
+			continue
+		}
+		if err := buyItem(playerStore, username, key, count, shop); err != nil {
+			fmt.Printf("Could not buy that: %v\n", err)
+			continue
+		}
+		fmt.Printf("Bought %d %s for ₽%d.\n", count, shop.Items[key].Name, count*shop.Items[key].Price)
+	}
+}
+
+// itemEvolutions lists a species' evolutions triggered by using an item
+func itemEvolutions(from Species) []Evolution {
+	var evolutions []Evolution
+	for _, evolution := range from.Evolutions {
+		if evolution.Trigger == "item" {
+			evolutions = append(evolutions, evolution)
+		}
+	}
+	return evolutions
+}
+
+// evolvesWith reports whether a species evolves into another when given an item
+func evolvesWith(from *Species, item, to string) bool {
+	if from == nil {
+		return false
+	}
+	for _, evolution := range itemEvolutions(*from) {
+		if evolution.Item == item && evolution.To == to {
+			return true
+		}
+	}
+	return false
+}
+
+// itemName turns an item key such as "thunder_stone" into "Thunder Stone"
+func itemName(key string) string {
+	words := strings.Split(key, "_")
+	for i, word := range words {
+		if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// manageTrades lets a logged-in player offer Pokémon to other players and answer the offers made to them
+func manageTrades() {
+	reader := bufio.NewReader(os.Stdin)
+	username, ok := login(reader)
+	if !ok {
+		fmt.Println("Invalid username or password.")
+		return
+	}
+
+	for {
+		trades, err := loadTrades(tradesFile)
+		if err != nil {
+			fmt.Printf("Failed to load trades: %v\n", err)
+			return
+		}
+		records, err := loadPlayerRecords(playerStore)
+		if err != nil {
+			fmt.Printf("Failed to load player data: %v\n", err)
+			return
+		}
+
+		fmt.Println("\nOpen trades:")
+		open := 0
+		for _, trade := range trades {
+			if isOpen(trade) && (trade.From == username || trade.To == username) {
+				open++
+				fmt.Printf("  %s\n", describeTrade(trade, records, username))
+			}
+		}
+		if open == 0 {
+			fmt.Println("  (none)")
+		}
+
+		fmt.Println("1. Offer a Pokémon")
+		fmt.Println("2. Answer a trade")
+		fmt.Println("3. Cancel one of your offers")
+		fmt.Println("4. Back")
+		fmt.Print("Enter your choice: ")
+		switch readLine(reader) {
+		case "1":
+			offerTrade(reader, username, records)
+		case "2":
+			answerTrade(reader, username, trades, records)
+		case "3":
+			cancelTrade(reader, username, trades, records)
+		case "4", "":
+			return
+		default:
+			fmt.Println("Invalid choice.")
+		}
+	}
+}
+
+// offerTrade asks which Pokémon to offer, to whom, and what to ask for in return
+func offerTrade(reader *bufio.Reader, username string, records []map[string]interface{}) {
+	roster := rosterOf(recordOf(records, username))
+	if len(roster) == 0 {
+		fmt.Println("You have no Pokémon to trade.")
+		return
+	}
+	offered, ok := choosePokemon(reader, "Your Pokémon:", roster, "Enter the number of the Pokémon to offer: ")
+	if !ok {
+		return
+	}
+
+	fmt.Print("Enter the username of the player to offer it to: ")
+	to := readLine(reader)
+	if to == username {
+		fmt.Println("You cannot trade with yourself.")
+		return
+	}
+	if !accountExists(to) {
+		fmt.Printf("There is no player named %s.\n", to)
+		return
+	}
+	record := recordOf(records, to)
+	if record == nil {
+		fmt.Printf("%s has not played Pokecat yet.\n", to)
+		return
+	}
+
+	requested := ""
+	if theirs := rosterOf(record); len(theirs) > 0 {
+		fmt.Printf("%s's Pokémon:\n", to)
+		for i, pokemon := range theirs {
+			fmt.Printf("  %d. %s\n", i+1, describePokemon(pokemon))
+		}
+		fmt.Print("Enter the number of the Pokémon you want in return, or press Enter to give yours as a gift: ")
+		if line := readLine(reader); line != "" {
+			index, err := strconv.Atoi(line)
+			if err != nil || index < 1 || index > len(theirs) {
+				fmt.Println("Invalid Pokémon number.")
+				return
+			}
+			requested = instanceID(theirs[index-1])
+		}
+	}
+
+	id, err := newTradeID()
+	if err != nil {
+		fmt.Printf("Failed to create the trade: %v\n", err)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	trade := Trade{ID: id, From: username, To: to, Offered: instanceID(offered), Requested: requested,
+		Status: "pending", CreatedAt: now, UpdatedAt: now}
+	if err := saveOffer(playerStore, trade); err != nil {
+		fmt.Printf("Failed to offer the trade: %v\n", err)
+		return
+	}
+	fmt.Printf("Offered %s to %s. They can answer from the Trade Pokémon menu.\n", describePokemon(offered), to)
+}
+
+// answerTrade lets a player accept, counter or decline a trade waiting for them
+func answerTrade(reader *bufio.Reader, username string, trades []Trade, records []map[string]interface{}) {
+	var waiting []Trade
+	fmt.Println("Trades waiting for you:")
+	for _, trade := range trades {
+		if isOpen(trade) && answeredBy(trade) == username {
+			waiting = append(waiting, trade)
+			fmt.Printf("  %d. %s\n", len(waiting), describeTrade(trade, records, username))
+		}
+	}
+	if len(waiting) == 0 {
+		fmt.Println("  (none)")
+		return
+	}
+	fmt.Print("Enter the number of a trade, or press Enter to go back: ")
+	choice, err := strconv.Atoi(readLine(reader))
+	if err != nil || choice < 1 || choice > len(waiting) {
+		return
+	}
+	trade := waiting[choice-1]
+
+	fmt.Println("1. Accept")
+	if trade.Status == "pending" {
+		fmt.Println("2. Counter with a different Pokémon of yours")
+	}
+	fmt.Println("3. Decline")
+	fmt.Print("Enter your choice: ")
+	switch readLine(reader) {
+	case "1":
+		evolutions, err := completeTrade(playerStore, trade.ID, username)
+		if err != nil {
+			fmt.Printf("The trade did not go through: %v\n", err)
+			return
+		}
+		fmt.Println("Trade complete!")
+		for _, evolution := range evolutions {
+			fmt.Println(evolution)
+		}
+	case "2":
+		if trade.Status != "pending" {
+			fmt.Println("Invalid choice.")
+			return
+		}
+		roster := rosterOf(recordOf(records, username))
+		counter, ok := choosePokemon(reader, "Your Pokémon:", roster, "Enter the number of the Pokémon to give instead: ")
+		if !ok {
+			return
+		}
+		if instanceID(counter) == trade.Requested {
+			fmt.Println("That is the Pokémon already asked for; accept the trade instead.")
+			return
+		}
+		if err := counterTrade(playerStore, trade.ID, username, instanceID(counter)); err != nil {
+			fmt.Printf("Failed to counter the trade: %v\n", err)
+			return
+		}
+		fmt.Printf("Countered with %s. %s can now accept or decline.\n", describePokemon(counter), trade.From)
+	case "3":
+		if err := closeTrade(playerStore, trade.ID, username, "declined"); err != nil {
+			fmt.Printf("Failed to decline the trade: %v\n", err)
+			return
+		}
+		fmt.Println("Trade declined.")
+	default:
+		fmt.Println("Invalid choice.")
+	}
+}
+
+// cancelTrade withdraws one of the player's own open offers
+func cancelTrade(reader *bufio.Reader, username string, trades []Trade, records []map[string]interface{}) {
+	var mine []Trade
+	fmt.Println("Your open offers:")
+	for _, trade := range trades {
+		if isOpen(trade) && trade.From == username {
+			mine = append(mine, trade)
+			fmt.Printf("  %d. %s\n", len(mine), describeTrade(trade, records, username))
+		}
+	}
+	if len(mine) == 0 {
+		fmt.Println("  (none)")
+		return
+	}
+	fmt.Print("Enter the number of the offer to cancel, or press Enter to go back: ")
+	choice, err := strconv.Atoi(readLine(reader))
+	if err != nil || choice < 1 || choice > len(mine) {
+		return
+	}
+	if err := closeTrade(playerStore, mine[choice-1].ID, username, "cancelled"); err != nil {
+		fmt.Printf("Failed to cancel the trade: %v\n", err)
+		return
+	}
+	fmt.Println("Offer cancelled.")
+}
+
+// choosePokemon lists a roster and asks the player to pick one of its Pokémon
+func choosePokemon(reader *bufio.Reader, title string, roster []map[string]interface{}, prompt string) (map[string]interface{}, bool) {
+	fmt.Println(title)
+	for i, pokemon := range roster {
+		fmt.Printf("  %d. %s\n", i+1, describePokemon(pokemon))
+	}
+	fmt.Print(prompt)
+	index, err := strconv.Atoi(readLine(reader))
+	if err != nil || index < 1 || index > len(roster) {
+		fmt.Println("Invalid Pokémon number.")
+		return nil, false
+	}
+	return roster[index-1], true
+}
+
+// describeTrade summarizes a trade from the point of view of one of its players
+func describeTrade(trade Trade, records []map[string]interface{}, username string) string {
+	offered := "a Pokémon that is no longer theirs"
+	if pokemon := findPokemon(rosterOf(recordOf(records, trade.From)), trade.Offered); pokemon != nil {
+		offered = describePokemon(pokemon)
+	}
+	requested := "nothing (a gift)"
+	if trade.Requested != "" {
+		requested = "a Pokémon that is no longer theirs"
+		if pokemon := findPokemon(rosterOf(recordOf(records, trade.To)), trade.Requested); pokemon != nil {
+			requested = describePokemon(pokemon)
+		}
+	}
+	summary := fmt.Sprintf("%s gives %s to %s for %s", trade.From, offered, trade.To, requested)
+	if trade.Status == "countered" {
+		summary += " (countered by " + trade.To + ")"
+	}
+	if answeredBy(trade) == username {
+		return summary + " - waiting for you"
+	}
+	return summary + " - waiting for " + answeredBy(trade)
+}
+
+// isOpen reports whether a trade can still be answered
+func isOpen(trade Trade) bool {
+	return trade.Status == "pending" || trade.Status == "countered"
+}
+
+// answeredBy returns whose turn it is to answer an open trade: the recipient of an offer, or the offerer
+// once the recipient has countered
+func answeredBy(trade Trade) string {
+	if trade.Status == "countered" {
+		return trade.From
+	}
+	return trade.To
+}
+
+// accountExists checks whether a username is registered
+func accountExists(username string) bool {
+	exists, err := accounts.Exists(username)
+	if err != nil {
+		log.Printf("Failed to look up account: %v", err)
+		return false
+	}
+	return exists
+}
+
+// recordOf returns one player's record from the loaded player records, or nil if they have none
+func recordOf(records []map[string]interface{}, playerName string) map[string]interface{} {
+	for _, record := range records {
+		if record["player_name"] == playerName {
+			return record
+		}
+	}
+	return nil
+}
+
+// saveOffer records a new trade once both Pokémon are confirmed to be owned and not already promised
+// in another open trade
+func saveOffer(players store.Store, trade Trade) error {
+	return updateTrades(players, func(book *tradeBook) error {
+		trade.Offered, trade.Requested = book.current(trade.From, trade.Offered), book.current(trade.To, trade.Requested)
+		offered := book.pokemon(trade.From, trade.Offered)
+		if offered == nil {
+			return fmt.Errorf("you no longer own that Pokémon")
+		}
+		var requested map[string]interface{}
+		if trade.Requested != "" {
+			if requested = book.pokemon(trade.To, trade.Requested); requested == nil {
+				return fmt.Errorf("%s no longer owns that Pokémon", trade.To)
+			}
+		}
+		if other := promisedIn(book.trades, trade.Offered); other != "" {
+			return fmt.Errorf("that Pokémon is already offered in trade %s", other)
+		}
+		book.log(trade, "offered", trade.From, offered, requested, "")
+		book.trades = append(book.trades, trade)
+		return nil
+	})
+}
+
+// counterTrade lets the recipient of an offer ask to give a different Pokémon of theirs instead
+func counterTrade(players store.Store, tradeID, by, counter string) error {
+	return updateTrades(players, func(book *tradeBook) error {
+		trade := findTrade(book.trades, tradeID)
+		if trade == nil || trade.Status != "pending" || trade.To != by {
+			return fmt.Errorf("trade %s is no longer waiting for you", tradeID)
+		}
+		counter = book.current(by, counter)
+		pokemon := book.pokemon(by, counter)
+		if pokemon == nil {
+			return fmt.Errorf("you no longer own that Pokémon")
+		}
+		if other := promisedIn(book.trades, counter); other != "" {
+			return fmt.Errorf("that Pokémon is already offered in trade %s", other)
+		}
+		trade.Requested = counter
+		trade.Status = "countered"
+		trade.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		book.log(*trade, "countered", by, book.pokemon(trade.From, trade.Offered), pokemon, "")
+		return nil
+	})
+}
+
+// closeTrade declines or cancels an open trade
+func closeTrade(players store.Store, tradeID, by, status string) error {
+	return updateTrades(players, func(book *tradeBook) error {
+		trade := findTrade(book.trades, tradeID)
+		if trade == nil || !isOpen(*trade) {
+			return fmt.Errorf("trade %s is no longer open", tradeID)
+		}
+		if status == "declined" && answeredBy(*trade) != by || status == "cancelled" && trade.From != by {
+			return fmt.Errorf("trade %s is not yours to %s", tradeID, strings.TrimSuffix(status, "d"))
+		}
+		trade.Status = status
+		trade.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		book.log(*trade, status, by, book.pokemon(trade.From, trade.Offered), book.pokemon(trade.To, trade.Requested), "")
+		return nil
+	})
+}
+
+// completeTrade swaps the Pokémon of an accepted trade between both players' rosters in a single write
+// to player_data.json. Both Pokémon are checked to still be owned under the lock, so a Pokémon that
+// changed hands in another trade fails this one instead of being given away twice. Any other open
+// trades promising a Pokémon that moved fail with it. It returns messages about trade evolutions.
+func completeTrade(players store.Store, tradeID, by string) ([]string, error) {
+	species, err := loadSpecies(store.DataPath("pokedex.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var evolutions []string
+	failed := false
+	err = updateTrades(players, func(book *tradeBook) error {
+		trade := findTrade(book.trades, tradeID)
+		if trade == nil || !isOpen(*trade) || answeredBy(*trade) != by {
+			return fmt.Errorf("trade %s is no longer waiting for you", tradeID)
+		}
+		from, to := recordOf(book.records, trade.From), recordOf(book.records, trade.To)
+		offered := book.pokemon(trade.From, trade.Offered)
+		var requested map[string]interface{}
+		if trade.Requested != "" {
+			requested = book.pokemon(trade.To, trade.Requested)
+		}
+		now := time.Now().UTC().Format(time.RFC3339)
+		if offered == nil || trade.Requested != "" && requested == nil {
+			// The failure is saved and audited rather than returned, so the trade does not stay open
+			trade.Status, trade.UpdatedAt = "failed", now
+			book.log(*trade, "failed", by, offered, requested, "a Pokémon in the trade changed hands")
+			failed = true
+			return nil
+		}
+
+		offeredSnapshot, requestedSnapshot := snapshot(offered), snapshot(requested)
+		movePokemon(from, to, offered)
+		if message := tradeEvolve(to, offered, species, offeredSnapshot); message != "" {
+			evolutions = append(evolutions, message)
+		}
+		if requested != nil {
+			movePokemon(to, from, requested)
+			if message := tradeEvolve(from, requested, species, requestedSnapshot); message != "" {
+				evolutions = append(evolutions, message)
+			}
+		}
+
+		trade.Status, trade.UpdatedAt = "completed", now
+		book.events = append(book.events, TradeEvent{Time: now, TradeID: trade.ID, Event: "completed", By: by,
+			From: trade.From, To: trade.To, Offered: offeredSnapshot, Requested: requestedSnapshot})
+
+		for i := range book.trades {
+			other := &book.trades[i]
+			if other.ID == trade.ID || !isOpen(*other) {
+				continue
+			}
+			if other.Offered == trade.Offered || other.Requested == trade.Offered ||
+				requested != nil && (other.Offered == trade.Requested || other.Requested == trade.Requested) {
+				other.Status, other.UpdatedAt = "failed", now
+				book.log(*other, "failed", by, book.find(other.Offered), book.find(other.Requested),
+					"a Pokémon in the trade was traded away in trade "+trade.ID)
+			}
+		}
+		return nil
+	})
+	if err == nil && failed {
+		err = fmt.Errorf("a Pokémon in it is no longer owned by its trainer, so the trade was called off")
+	}
+	return evolutions, err
+}
+
+// movePokemon takes a Pokémon out of one player's roster and team presets and adds it to another's roster
+func movePokemon(from, to, pokemon map[string]interface{}) {
+	id := instanceID(pokemon)
+	kept := []interface{}{}
+	for _, p := range rosterOf(from) {
+		if instanceID(p) != id {
+			kept = append(kept, p)
+		}
+	}
+	from["pokemons"] = kept
+
+	teams := teamsOf(from)
+	for i := range teams {
+		var ids []string
+		for _, teamID := range teams[i].PokemonIDs {
+			if teamID != id {
+				ids = append(ids, teamID)
+			}
+		}
+		teams[i].PokemonIDs = ids
+	}
+	if teams != nil {
+		from["teams"] = teams
+	}
+
+	pokemons, _ := to["pokemons"].([]interface{})
+	to["pokemons"] = append(pokemons, pokemon)
+}
+
+// tradeEvolve evolves a Pokémon that evolves when traded, using up its held item if the evolution needs
+// one, and records its species as caught by its new trainer. It returns a message if it evolved.
+func tradeEvolve(record, pokemon map[string]interface{}, species []Species, traded *TradedPokemon) string {
+	from := findSpecies(species, fmt.Sprint(pokemon["id"]))
+	if from == nil {
+		return ""
+	}
+	for _, evolution := range from.Evolutions {
+		if evolution.Trigger != "trade" {
+			continue
+		}
+		held, _ := pokemon["held_item"].(string)
+		if evolution.Item != "" && held != evolution.Item {
+			continue
+		}
+		to := findSpecies(species, evolution.To)
+		if to == nil {
+			continue
+		}
+		if evolution.Item != "" {
+			delete(pokemon, "held_item")
+		}
+		recordCaught(record, to.ID, species)
+		pokemon["id"] = to.ID
+		pokemon["name"] = to.Name
+		pokemon["types"] = to.Types
+		pokemon["stats"] = to.Stats
+		pokemon["exp"] = to.Exp
+		pokemon["when_attacked"] = to.WhenAttacked
+		traded.EvolvedInto = to.Name
+		return fmt.Sprintf("What? %s evolved into %s!", from.Name, to.Name)
+	}
+	recordCaught(record, from.ID, species)
+	return ""
+}
+
+// tradeBook is what a change to trades sees and makes while holding the trades lock
+type tradeBook struct {
+	records []map[string]interface{}
+	trades  []Trade
+	events  []TradeEvent                 // Audit events, logged once the change is saved
+	renamed map[string]map[string]string // New instance IDs of each player's legacy Pokémon, by species ID
+}
+
+// pokemon returns a Pokémon a player owns, or nil if they do not own it
+func (b *tradeBook) pokemon(playerName, id string) map[string]interface{} {
+	return findPokemon(rosterOf(recordOf(b.records, playerName)), b.current(playerName, id))
+}
+
+// current turns the species ID a legacy Pokémon was known by into the instance ID it was just given
+func (b *tradeBook) current(playerName, id string) string {
+	if instance, ok := b.renamed[playerName][id]; ok {
+		return instance
+	}
+	return id
+}
+
+// find returns a Pokémon whoever owns it, or nil if nobody does
+func (b *tradeBook) find(id string) map[string]interface{} {
+	for _, record := range b.records {
+		if pokemon := findPokemon(rosterOf(record), id); pokemon != nil && id != "" {
+			return pokemon
+		}
+	}
+	return nil
+}
+
+// log queues an audit event about a trade and the Pokémon involved
+func (b *tradeBook) log(trade Trade, event, by string, offered, requested map[string]interface{}, reason string) {
+	b.events = append(b.events, TradeEvent{Time: time.Now().UTC().Format(time.RFC3339), TradeID: trade.ID,
+		Event: event, By: by, From: trade.From, To: trade.To, Offered: snapshot(offered), Requested: snapshot(requested),
+		Reason: reason})
+}
+
+// updateTrades applies a change to trades.json and the player records. It holds the trades lock throughout
+// and changes the records in a single store update, so checking who owns a Pokémon and moving it happen as
+// one step that no other trade, hub, Pokecat or Pokebat write can interleave with. The records are saved
+// before the trades, so a crash in between leaves an accepted trade open, and retrying it fails safely
+// because its Pokémon have already moved.
+func updateTrades(players store.Store, change func(book *tradeBook) error) error {
+	unlock, err := store.LockFile(tradesFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	book := &tradeBook{}
+	if book.trades, err = loadTrades(tradesFile); err != nil {
+		return err
+	}
+	err = updatePlayerRecords(players, func(records []map[string]interface{}) error {
+		book.records = records
+		// Legacy Pokémon share their species ID, so a trade could give a player two Pokémon with one ID.
+		// Every Pokémon gets its own instance ID before anything moves, and open trades follow.
+		book.renamed = make(map[string]map[string]string)
+		for _, record := range records {
+			renamed, err := store.AssignInstanceIDs(record)
+			if err != nil {
+				return err
+			}
+			book.renamed[fmt.Sprint(record["player_name"])] = renamed
+		}
+		for i := range book.trades {
+			if trade := &book.trades[i]; isOpen(*trade) {
+				trade.Offered = book.current(trade.From, trade.Offered)
+				trade.Requested = book.current(trade.To, trade.Requested)
+			}
+		}
+		return change(book)
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(book.trades, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal trades: %v", err)
+	}
+	if err := store.WriteFileAtomic(tradesFile, data); err != nil {
+		return err
+	}
+	for _, event := range book.events {
+		appendTradeLog(event)
+	}
+	return nil
+}
+
+// loadTrades reads trades.json; no file means no trades have been offered yet
+func loadTrades(filename string) ([]Trade, error) {
+	file, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trades: %v", err)
+	}
+	var trades []Trade
+	if err := json.Unmarshal(file, &trades); err != nil {
+		return nil, fmt.Errorf("failed to parse trades: %v", err)
+	}
+	return trades, nil
+}
+
+// findTrade looks up a trade by ID
+func findTrade(trades []Trade, id string) *Trade {
+	for i := range trades {
+		if trades[i].ID == id {
+			return &trades[i]
+		}
+	}
+	return nil
+}
+
+// promisedIn returns the ID of an open trade that already offers a Pokémon, or "" if none does
+func promisedIn(trades []Trade, id string) string {
+	for _, trade := range trades {
+		if isOpen(trade) && (trade.Offered == id || trade.Requested == id) {
+			return trade.ID
+		}
+	}
+	return ""
+}
+
+// newTradeID makes a random ID for a trade
+func newTradeID() (string, error) {
+	buffer := make([]byte, 6)
+	if _, err := crand.Read(buffer); err != nil {
+		return "", fmt.Errorf("failed to generate trade ID: %v", err)
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+// snapshot records which Pokémon took part in a trade, or nil if there was none
+func snapshot(pokemon map[string]interface{}) *TradedPokemon {
+	if pokemon == nil {
+		return nil
+	}
+	nickname, _ := pokemon["nickname"].(string)
+	return &TradedPokemon{InstanceID: instanceID(pokemon), ID: fmt.Sprint(pokemon["id"]), Name: fmt.Sprint(pokemon["name"]),
+		Nickname: nickname}
+}
+
+// appendTradeLog writes one event to trade_log.jsonl, which is only ever appended to
+func appendTradeLog(event TradeEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal trade event: %v", err)
+		return
+	}
+	file, err := os.OpenFile(tradeLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open trade log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write trade log: %v", err)
+	}
+}
+
+// showPokedex prints a logged-in player's Pokédex completion and when they first saw and caught each species
+func showPokedex() {
+	reader := bufio.NewReader(os.Stdin)
+	username, ok := login(reader)
+	if !ok {
+		fmt.Println("Invalid username or password.")
+		return
+	}
+
+	record, err := loadPlayerRecord(playerStore, username)
+	if err != nil {
+		fmt.Printf("Failed to load your player data: %v\n", err)
+		return
+	}
+	species, err := loadSpecies(store.DataPath("pokedex.json"))
+	if err != nil {
+		fmt.Printf("Failed to load Pokédex: %v\n", err)
+		return
+	}
+
+	dex := dexOf(record)
+	seen, caught := 0, 0
+	for _, s := range species {
+		if entry, ok := dex[s.ID]; ok {
+			seen++
+			if entry.Caught {
+				caught++
+			}
+		}
+	}
+	fmt.Printf("\nPokédex of %s:\n", username)
+	fmt.Printf("  Seen:   %d/%d (%.1f%%)\n", seen, len(species), 100*float64(seen)/float64(max(len(species), 1)))
+	fmt.Printf("  Caught: %d/%d (%.1f%%)\n", caught, len(species), 100*float64(caught)/float64(max(len(species), 1)))
+	for _, s := range species {
+		entry, ok := dex[s.ID]
+		if !ok {
+			continue
+		}
+		status := "seen " + dexDate(entry.FirstSeen)
+		if entry.Caught {
+			status += ", caught " + dexDate(entry.FirstCaught)
+		}
+		fmt.Printf("  #%03s %-12s %s\n", s.ID, s.Name, status)
+	}
+}
+
+// dexOf returns the Pokédex saved in a player record, counting species in the "seen" list saved before
+// the Pokédex kept entries as seen and owned Pokémon as caught
+func dexOf(record map[string]interface{}) map[string]DexEntry {
+	var dex map[string]DexEntry
+	data, _ := json.Marshal(record["pokedex"])
+	json.Unmarshal(data, &dex)
+	if dex == nil {
+		dex = make(map[string]DexEntry)
+	}
+	seen, _ := record["seen"].([]interface{})
+	for _, id := range seen {
+		if _, ok := dex[fmt.Sprint(id)]; !ok {
+			dex[fmt.Sprint(id)] = DexEntry{}
+		}
+	}
+	for _, pokemon := range rosterOf(record) {
+		id := fmt.Sprint(pokemon["id"])
+		if entry := dex[id]; !entry.Caught {
+			entry.Caught = true
+			dex[id] = entry
+		}
+	}
+	return dex
+}
+
+// dexDate shortens a Pokédex timestamp to its date
+func dexDate(stamp string) string {
+	if len(stamp) < len("2006-01-02") {
+		return "(date unknown)"
+	}
+	return stamp[:len("2006-01-02")]
+}
+
+// createTeam asks the player to name a new preset and pick its Pokémon from their roster
+func createTeam(reader *bufio.Reader, roster []map[string]interface{}, teams []TeamPreset) (TeamPreset, bool) {
+	fmt.Print("Enter a name for the team: ")
+	name := readLine(reader)
+	if name == "" || strings.Contains(name, " ") {
+		fmt.Println("Team names must be a single word.")
+		return TeamPreset{}, false
+	}
+	for _, team := range teams {
+		if strings.EqualFold(team.Name, name) {
+			fmt.Printf("You already have a team named %s.\n", team.Name)
+			return TeamPreset{}, false
+		}
+	}
+
+	fmt.Println("Your Pokémon:")
+	for i, pokemon := range roster {
+		fmt.Printf("  %d. %s (ID: %v)\n", i+1, describePokemon(pokemon), pokemon["id"])
+	}
+	fmt.Print("Choose Pokémon by entering their numbers (separated by space): ")
+
+	team := TeamPreset{Name: name}
+	picked := make(map[int]bool)
+	for _, field := range strings.Fields(readLine(reader)) {
+		index, err := strconv.Atoi(field)
+		if err != nil || index < 1 || index > len(roster) || picked[index] {
+			fmt.Printf("Invalid choice number: %s.\n", field)
+			return TeamPreset{}, false
+		}
+		picked[index] = true
+		team.PokemonIDs = append(team.PokemonIDs, instanceID(roster[index-1]))
+	}
+	if len(team.PokemonIDs) == 0 {
+		fmt.Println("A team needs at least one Pokémon.")
+		return TeamPreset{}, false
+	}
+	return team, true
+}
+
+// describeTeam lists the names of a preset's Pokémon, flagging ones no longer owned
+func describeTeam(team TeamPreset, roster []map[string]interface{}) string {
+	names := make([]string, 0, len(team.PokemonIDs))
+	for _, id := range team.PokemonIDs {
+		name := fmt.Sprintf("#%s (no longer owned)", id)
+		for _, pokemon := range roster {
+			if instanceID(pokemon) == id {
+				name = describePokemon(pokemon)
+				break
+			}
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// login checks a username and password against the registered accounts
+func login(reader *bufio.Reader) (string, bool) {
+	fmt.Print("Enter your username: ")
+	username := readLine(reader)
+	fmt.Print("Enter your password: ")
+	password := readLine(reader)
+
+	ok, err := accounts.Login(username, password)
+	if err != nil {
+		log.Printf("Failed to check account: %v", err)
+		return "", false
+	}
+	if !ok {
+		return "", false
+	}
+	return username, true
+}
+
+// readLine reads one trimmed line from the reader
+func readLine(reader *bufio.Reader) string {
+	line, _ := reader.ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+// loadPlayerRecords reads every player's saved record
+func loadPlayerRecords(players store.Store) ([]map[string]interface{}, error) {
+	return players.Load()
+}
+
+// loadPlayerRecord returns a single player's saved record
+func loadPlayerRecord(players store.Store, playerName string) (map[string]interface{}, error) {
+	record, err := store.Player(players, playerName)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("no saved data for %s, play Pokecat first", playerName)
+	}
+	return record, nil
+}
+
+// rosterOf returns the Pokémon owned in a player record
+func rosterOf(record map[string]interface{}) []map[string]interface{} {
+	var roster []map[string]interface{}
+	pokemons, _ := record["pokemons"].([]interface{})
+	for _, p := range pokemons {
+		if pokemon, ok := p.(map[string]interface{}); ok {
+			roster = append(roster, pokemon)
+		}
+	}
+	return roster
+}
+
+// teamsOf returns the team presets saved in a player record
+func teamsOf(record map[string]interface{}) []TeamPreset {
+	var teams []TeamPreset
+	data, _ := json.Marshal(record["teams"])
+	json.Unmarshal(data, &teams)
+	return teams
+}
+
+// saveHeldItem sets the held item of one of a player's Pokémon
+func saveHeldItem(players store.Store, playerName, id string, heldItem string) error {
+	return updatePlayerRecords(players, func(records []map[string]interface{}) error {
+		for _, record := range records {
+			if record["player_name"] != playerName {
+				continue
+			}
+			pokemon := findPokemon(rosterOf(record), id)
+			if pokemon == nil {
+				return fmt.Errorf("you no longer own that Pokémon")
+			}
+			if heldItem == "" {
+				delete(pokemon, "held_item")
+			} else {
+				pokemon["held_item"] = heldItem
+			}
+		}
+		return nil
+	})
+}
+
+// buyItem takes the price of some items from a player's money and adds them to their inventory
+func buyItem(players store.Store, playerName, key string, count int, shop *store.Shop) error {
+	item, ok := shop.Items[key]
+	if !ok {
+		return fmt.Errorf("the shop does not sell %s", key)
+	}
+	return updatePlayerRecords(players, func(records []map[string]interface{}) error {
+		for _, record := range records {
+			if record["player_name"] != playerName {
+				continue
+			}
+			money, inventory, err := shop.WalletOf(record)
+			if err != nil {
+				return err
+			}
+			if cost := count * item.Price; cost > money {
+				return fmt.Errorf("that costs ₽%d but you only have ₽%d", cost, money)
+			}
+			inventory[key] += count
+			record["money"], record["inventory"] = money-count*item.Price, inventory
+			return nil
+		}
+		return fmt.Errorf("no saved data for %s, play Pokecat first", playerName)
+	})
+}
+
+// loadSpecies reads every entry of pokedex.json
+func loadSpecies(filename string) ([]Species, error) {
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Pokédex: %v", err)
+	}
+	var species []Species
+	if err := json.Unmarshal(file, &species); err != nil {
+		return nil, fmt.Errorf("failed to parse Pokédex: %v", err)
+	}
+	return species, nil
+}
+
+// findSpecies looks up a Pokédex entry by ID
+func findSpecies(species []Species, id string) *Species {
+	for i := range species {
+		if species[i].ID == id {
+			return &species[i]
+		}
+	}
+	return nil
+}
+
+// saveEvolution uses up an evolution item to turn one of a player's Pokémon into another species, keeping its
+// instance ID, nickname, level, individual values, nature and held item, and adds it to their Pokédex
+func saveEvolution(players store.Store, playerName, id, item string, to Species, species []Species, shop *store.Shop) error {
+	return updatePlayerRecords(players, func(records []map[string]interface{}) error {
+		for _, record := range records {
+			if record["player_name"] != playerName {
+				continue
+			}
+			pokemon := findPokemon(rosterOf(record), id)
+			if pokemon == nil {
+				return fmt.Errorf("you no longer own that Pokémon")
+			}
+			// It may have evolved or been traded away and back since the player picked it
+			if !evolvesWith(findSpecies(species, fmt.Sprint(pokemon["id"])), item, to.ID) {
+				return fmt.Errorf("that Pokémon can no longer evolve into %s with a %s", to.Name, itemName(item))
+			}
+			money, inventory, err := shop.WalletOf(record)
+			if err != nil {
+				return err
+			}
+			if inventory[item] <= 0 {
+				return fmt.Errorf("you have no %s, buy one at the shop", itemName(item))
+			}
+			inventory[item]--
+			record["money"], record["inventory"] = money, inventory
+			recordCaught(record, to.ID, species)
+			pokemon["id"] = to.ID
+			pokemon["name"] = to.Name
+			pokemon["types"] = to.Types
+			pokemon["stats"] = to.Stats
+			pokemon["exp"] = to.Exp
+			pokemon["when_attacked"] = to.WhenAttacked
+		}
+		return nil
+	})
+}
+
+// recordCaught marks a species as caught in a player's Pokédex and updates its completion
+func recordCaught(record map[string]interface{}, id string, species []Species) {
+	dex := dexOf(record)
+	if entry := dex[id]; !entry.Caught {
+		now := time.Now().UTC().Format(time.RFC3339)
+		if entry.FirstSeen == "" {
+			entry.FirstSeen = now
+		}
+		entry.Caught, entry.FirstCaught = true, now
+		dex[id] = entry
+	}
+
+	seen, caught := 0, 0
+	for _, s := range species {
+		if entry, ok := dex[s.ID]; ok {
+			seen++
+			if entry.Caught {
+				caught++
+			}
+		}
+	}
+	record["pokedex"] = dex
+	record["pokedex_completion"] = map[string]interface{}{
+		"seen":           seen,
+		"caught":         caught,
+		"total":          len(species),
+		"seen_percent":   math.Round(1000*float64(seen)/float64(max(len(species), 1))) / 10,
+		"caught_percent": math.Round(1000*float64(caught)/float64(max(len(species), 1))) / 10,
+	}
+}
+
+// saveNickname sets the nickname of one of a player's Pokémon
+func saveNickname(players store.Store, playerName, id string, nickname string) error {
+	return updatePlayerRecords(players, func(records []map[string]interface{}) error {
+		for _, record := range records {
+			if record["player_name"] != playerName {
+				continue
+			}
+			pokemon := findPokemon(rosterOf(record), id)
+			if pokemon == nil {
+				return fmt.Errorf("you no longer own that Pokémon")
+			}
+			pokemon["nickname"] = nickname
+		}
+		return nil
+	})
+}
+
+// instanceID identifies one Pokémon in a roster. Records saved before every catch had its own
+// instance ID held one Pokémon per species, so those fall back to the species ID.
+func instanceID(pokemon map[string]interface{}) string {
+	if id, ok := pokemon["instance_id"].(string); ok && id != "" {
+		return id
+	}
+	return fmt.Sprint(pokemon["id"])
+}
+
+// findPokemon returns the Pokémon with an instance ID from a roster, or nil if it is not there
+func findPokemon(roster []map[string]interface{}, id string) map[string]interface{} {
+	for _, pokemon := range roster {
+		if instanceID(pokemon) == id {
+			return pokemon
+		}
+	}
+	return nil
+}
+
+// describePokemon names a Pokémon by nickname and species, with its catch date to tell duplicates apart
+func describePokemon(pokemon map[string]interface{}) string {
+	name := fmt.Sprint(pokemon["name"])
+	if nickname, _ := pokemon["nickname"].(string); nickname != "" {
+		name = fmt.Sprintf("%s the %s", nickname, name)
+	}
+	if caughtAt, _ := pokemon["caught_at"].(string); caughtAt != "" {
+		name += ", caught " + dexDate(caughtAt)
+	}
+	return name
+}
+
+// saveTeams replaces a player's team presets in player_data.json
+func saveTeams(players store.Store, playerName string, teams []TeamPreset) error {
+	return updatePlayerRecords(players, func(records []map[string]interface{}) error {
+		for _, record := range records {
+			if record["player_name"] == playerName {
+				record["teams"] = teams
+			}
+		}
+		return nil
+	})
+}
+
+// updatePlayerRecords applies a change to every saved player record. The store applies changes one at a
+// time, so changes made at the same time by Pokecat, Pokebat or another hub are never lost.
+func updatePlayerRecords(players store.Store, change func(records []map[string]interface{}) error) error {
+	return players.Update(func(records []store.Record) ([]store.Record, error) {
+		return records, change(records)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+// Run with: go test main.go main_test.go (crawler.go shares this directory but is a program of its own)
+
+import (
+	"path/filepath"
+	"testing"
+
+	"projec/store"
+)
+
+func TestTradeOneOfTwoLegacyPokemonOfASpecies(t *testing.T) {
+	dir := t.TempDir()
+	tradesFile, tradeLogFile = filepath.Join(dir, "trades.json"), filepath.Join(dir, "trade_log.jsonl")
+
+	// Saved before instance IDs, when each Pokémon was known by its species ID
+	players, err := store.NewMemory(
+		store.Record{"player_name": "ash", "pokemons": []interface{}{map[string]interface{}{"id": "1", "name": "Bulbasaur"}}},
+		store.Record{"player_name": "misty", "pokemons": []interface{}{map[string]interface{}{"id": "1", "name": "Bulbasaur"}},
+			"teams": []interface{}{map[string]interface{}{"name": "Main", "pokemon_ids": []interface{}{"1"}}}},
+	)
+	if err != nil {
+		t.Fatalf("NewMemory: %v", err)
+	}
+
+	// Ash's Bulbasaur goes to Misty, who already has one
+	if err := saveOffer(players, Trade{ID: "t1", From: "ash", To: "misty", Offered: "1", Status: "pending"}); err != nil {
+		t.Fatalf("saveOffer: %v", err)
+	}
+	if _, err := completeTrade(players, "t1", "misty"); err != nil {
+		t.Fatalf("completeTrade: %v", err)
+	}
+
+	misty, err := loadPlayerRecord(players, "misty")
+	if err != nil {
+		t.Fatalf("loadPlayerRecord: %v", err)
+	}
+	roster := rosterOf(misty)
+	if len(roster) != 2 {
+		t.Fatalf("misty has %d Pokémon, want 2", len(roster))
+	}
+	seen := make(map[string]bool)
+	for _, pokemon := range roster {
+		id, _ := pokemon["instance_id"].(string)
+		if id == "" || seen[id] {
+			t.Errorf("%s has instance ID %q, shared or missing", pokemon["name"], id)
+		}
+		seen[id] = true
+	}
+
+	// Her team preset follows her own Bulbasaur to its new instance ID
+	teams := teamsOf(misty)
+	if len(teams) != 1 || len(teams[0].PokemonIDs) != 1 || teams[0].PokemonIDs[0] != instanceID(roster[0]) {
+		t.Errorf("misty's team preset = %v, want her own Bulbasaur %s", teams, instanceID(roster[0]))
+	}
+
+	// Trading one of the two back takes only that one
+	mine := instanceID(roster[1])
+	if err := saveOffer(players, Trade{ID: "t2", From: "misty", To: "ash", Offered: mine, Status: "pending"}); err != nil {
+		t.Fatalf("saveOffer: %v", err)
+	}
+	if _, err := completeTrade(players, "t2", "ash"); err != nil {
+		t.Fatalf("completeTrade: %v", err)
+	}
+	if misty, err = loadPlayerRecord(players, "misty"); err != nil {
+		t.Fatalf("loadPlayerRecord: %v", err)
+	}
+	if got := rosterOf(misty); len(got) != 1 || instanceID(got[0]) != instanceID(roster[0]) {
+		t.Errorf("misty has %v after trading one away, want only her own Bulbasaur", got)
+	}
+	ash, err := loadPlayerRecord(players, "ash")
+	if err != nil {
+		t.Fatalf("loadPlayerRecord: %v", err)
+	}
+	if findPokemon(rosterOf(ash), mine) == nil {
+		t.Errorf("ash did not get %s: %v", mine, rosterOf(ash))
+	}
+}
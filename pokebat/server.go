@@ -2,28 +2,38 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"math"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"projec/store"
 )
-type Account struct{
-	Username string `json:"Name"`
-	Password string `json:"Password"`
-}
 
 type Pokemon struct {
+	InstanceID   string            `json:"instance_id"` // This particular Pokémon; ID is its species
 	ID           string            `json:"id"`
 	Name         string            `json:"name"`
+	Nickname     string            `json:"nickname,omitempty"`
+	CaughtAt     string            `json:"caught_at,omitempty"` // RFC 3339; empty for catches saved before it was recorded
 	Types        []string          `json:"types"`
 	Stats        Stats             `json:"stats"`
 	Exp          int               `json:"exp,string"`
+	Level        int               `json:"level,omitempty"`
 	WhenAttacked map[string]string `json:"when_attacked"`
+	Ability      string            `json:"ability,omitempty"`
+	HeldItem     string            `json:"held_item,omitempty"`
+	IVs          map[string]int    `json:"ivs,omitempty"`    // Individual values rolled when caught
+	Nature       string            `json:"nature,omitempty"` // Key into natures.json
+	MaxHP        int               `json:"-"` // HP at the start of the battle
 }
 
 type Stats struct {
@@ -36,13 +46,160 @@ type Stats struct {
 }
 
 type Player struct {
-	Name     string     `json:"name"`
-	Pokemons []*Pokemon `json:"pokemons"`
-	Active   *Pokemon   `json:"active"`
-	Conn     net.Conn
+	Name      string         `json:"name"`
+	Pokemons  []*Pokemon     `json:"pokemons"`
+	Actives   []*Pokemon     `json:"actives"` // One entry per active slot, nil once a slot can no longer be filled
+	Teams     []TeamPreset   `json:"teams"`
+	Inventory map[string]int `json:"inventory"` // Items left, by shop key
+	Used      map[string]int `json:"-"`         // Items used this battle, taken from the saved inventory afterwards
+	Conn      net.Conn
+}
+
+// TeamPreset is a named team saved from the Game Hub
+type TeamPreset struct {
+	Name       string   `json:"name"`
+	PokemonIDs []string `json:"pokemon_ids"`
+}
+
+// Battle formats, chosen when the match is created
+const (
+	FormatSingles = "singles"
+	FormatDoubles = "doubles"
+)
+
+// Level assumed for Pokémon saved without one, as in Pokecat, and the level the pokedex stats are for.
+// Battle stats scale from StatsLevel to the level a Pokémon battles at.
+const (
+	DefaultLevel = 30
+	StatsLevel   = 50
+)
+
+// Ruleset holds the battle rules loaded from the server's config file
+type Ruleset struct {
+	TeamSize         int      `json:"team_size"`
+	LevelCap         int      `json:"level_cap"`          // 0 disables the cap
+	NormalizeLevel   bool     `json:"normalize_level"`    // Battle every Pokémon at LevelCap instead of rejecting higher levels
+	BannedSpecies    []string `json:"banned_species"`     // Species names or pokedex IDs
+	SpeciesClause    bool     `json:"species_clause"`     // Forbid two Pokémon of the same species on a team
+	TurnTimerSeconds int      `json:"turn_timer_seconds"` // 0 disables the timer
+}
+
+// Hooks at which ability and item effects run during a battle
+const (
+	HookSwitchIn     = "switch_in"
+	HookBeforeDamage = "before_damage"
+	HookAfterDamage  = "after_damage"
+	HookEndOfTurn    = "end_of_turn"
+)
+
+// Effect is one data-driven behaviour of an ability or held item
+type Effect struct {
+	Hook       string  `json:"hook"`
+	Kind       string  `json:"kind"`                 // lower_foe_stat, boost_attack, reduce_damage, recoil, punish_contact or heal
+	Type       string  `json:"type,omitempty"`       // Only applies to attacks of this element
+	Stat       string  `json:"stat,omitempty"`       // Stat changed by lower_foe_stat
+	Multiplier float64 `json:"multiplier,omitempty"` // Applied to a stat or to damage
+	Fraction   float64 `json:"fraction,omitempty"`   // Share of max HP healed or lost
+	BelowHP    float64 `json:"below_hp,omitempty"`   // Only applies while the holder's HP is at or below this share
+}
+
+// EffectSource is an ability or held item as described in abilities.json and items.json
+type EffectSource struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Effects     []Effect `json:"effects"`
+}
+
+// Nature raises one stat and lowers another, as described in natures.json
+type Nature struct {
+	Name      string `json:"name"`
+	Increased string `json:"increased"` // Empty for neutral natures
+	Decreased string `json:"decreased"`
+}
+
+// Natures scale the stats they raise and lower by these factors
+const (
+	natureBoost = 1.1
+	natureDrop  = 0.9
+)
+
+// AbilityData is the layout of abilities.json
+type AbilityData struct {
+	Abilities map[string]EffectSource `json:"abilities"`
+	Species   map[string]string       `json:"species"` // Default ability by species name
+}
+
+var (
+	abilities        map[string]EffectSource
+	speciesAbilities map[string]string
+	items            map[string]EffectSource
+	natures          map[string]Nature
+	shop             *store.Shop
+	playerStore      store.Store     // Every player's saved Pokémon, money and items
+	accounts         store.Accounts  // Usernames and passwords players log in with
+	battleLog        store.BattleLog // Battles and ratings; nil unless a database is used
+)
+
+// Damage multiplier applied to each target of a spread attack
+const spreadDamageMultiplier = 0.75
+
+// Action is a single command chosen by a player for one of their active slots
+type Action struct {
+	Player   *Player
+	Foe      *Player
+	Pokemon  *Pokemon // Pokémon that chose the action
+	Slot     int      // Index into Player.Actives
+	Kind     string   // "attack", "spread", "switch" or "potion"
+	Target   int      // Foe slot targeted by an attack
+	SwitchTo *Pokemon // Pokémon brought in by a switch
+	Item     string   // Shop key of the potion used
 }
 
 func main() {
+	format := flag.String("format", FormatSingles, "battle format: singles or doubles")
+	rulesFile := flag.String("rules", "../rules.json", "path to the battle rules config file")
+	abilitiesFile := flag.String("abilities", "../abilities.json", "path to the ability data file")
+	itemsFile := flag.String("items", "../items.json", "path to the held item data file")
+	naturesFile := flag.String("natures", "../natures.json", "path to the nature data file")
+	shopFile := flag.String("shop", "../shop.json", "path to the item and reward data file")
+	playersFile := flag.String("players", store.DataPath("player_data.json"), "path to the saved player data shared with Pokecat and the hub")
+	accountsFile := flag.String("accounts", store.DataPath("accounts.json"), "path to the accounts players log in with")
+	dbFile := flag.String("db", "", "SQLite database to use instead of the accounts and player data files, filled by dbimport")
+	flag.Parse()
+	playerStore, accounts = store.OpenFile(*playersFile), store.OpenAccounts(*accountsFile)
+	if *dbFile == "" {
+		if err := store.RequireFiles(*playersFile, *accountsFile); err != nil {
+			log.Fatalf("Failed to open player data: %v", err)
+		}
+	} else {
+		db, err := store.OpenSQL(*dbFile)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.Close()
+		playerStore, accounts, battleLog = db, db, db
+	}
+	if *format != FormatSingles && *format != FormatDoubles {
+		log.Fatalf("Unknown battle format: %s", *format)
+	}
+
+	rules, err := loadRuleset(*rulesFile)
+	if err != nil {
+		log.Fatalf("Failed to load battle rules: %v", err)
+	}
+	if rules.TeamSize < activeSlots(*format) {
+		log.Fatalf("Team size %d is too small for %s battles", rules.TeamSize, *format)
+	}
+	if err := loadBattleEffects(*abilitiesFile, *itemsFile); err != nil {
+		log.Fatalf("Failed to load abilities and items: %v", err)
+	}
+	if err := loadNatures(*naturesFile); err != nil {
+		log.Fatalf("Failed to load natures: %v", err)
+	}
+	if shop, err = store.LoadShop(*shopFile); err != nil {
+		log.Fatalf("Failed to load shop: %v", err)
+	}
+
 	// Start the server
 	listener, err := net.Listen("tcp", ":8081")
 	if err != nil {
@@ -50,7 +207,7 @@ func main() {
 	}
 	defer listener.Close()
 
-	fmt.Println("Server started. Waiting for players...")
+	fmt.Printf("Server started (%s). Waiting for players...\n", *format)
 
 	players := make([]*Player, 0, 2)
 	playerNames := make(map[string]bool)
@@ -79,7 +236,7 @@ func main() {
 		}
 
 		// Use username as player_name to load data
-		playerData, err := loadPlayerData("../player_data.json", username)
+		playerData, err := loadPlayerData(playerStore, username)
 		if err != nil {
 			log.Printf("Failed to load player data for %s: %v", username, err)
 			conn.Write([]byte("Failed to load player data. Exiting.\n"))
@@ -97,31 +254,69 @@ func main() {
 
 		// Notify the player
 		conn.Write([]byte(fmt.Sprintf("Welcome back, %s! AWAIT THE BATTLE!!!!!\n", playerData.Name)))
+		conn.Write([]byte(rules.describe()))
 
 		fmt.Printf("Player %d connected from %s\n", len(players), conn.RemoteAddr())
 	}
 
-	for _, player := range players {
-		selectPokemons(player)
+	// Team preview: each player sees what the opponent could bring before choosing
+	for i, player := range players {
+		sendTeamPreview(player, players[1-i], rules)
 	}
 
-	// Simplify turn order logic based on speed
-	var firstPlayer, secondPlayer *Player
-	if players[0].Active.Stats.Speed > players[1].Active.Stats.Speed {
-		firstPlayer = players[0]
-		secondPlayer = players[1]
-	} else {
-		firstPlayer = players[1]
-		secondPlayer = players[0]
+	// Both players choose at the same time and nothing is revealed until both have locked in
+	errs := make([]error, len(players))
+	var wg sync.WaitGroup
+	for i, player := range players {
+		wg.Add(1)
+		go func(i int, player *Player, opponent *Player) {
+			defer wg.Done()
+			if errs[i] = selectPokemons(player, rules, activeSlots(*format)); errs[i] != nil {
+				// Unblock the opponent if they are still choosing
+				opponent.Conn.Close()
+				return
+			}
+			player.Conn.Write([]byte(fmt.Sprintf("Team locked in. Waiting for %s...\n", opponent.Name)))
+		}(i, player, players[1-i])
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("Team selection failed for %s: %v", players[i].Name, err)
+			for _, p := range players {
+				p.Conn.Write([]byte("The battle was cancelled during team selection.\n"))
+				p.Conn.Close()
+			}
+			return
+		}
+	}
+
+	// Reveal the leads now that both teams are committed
+	for i, player := range players {
+		opponent := players[1-i]
+		leads := make([]string, 0, len(opponent.Actives))
+		for _, pokemon := range opponent.Actives {
+			leads = append(leads, pokemon.Name)
+		}
+		player.Conn.Write([]byte(fmt.Sprintf("Both teams are locked in! %s leads with %s.\n", opponent.Name, strings.Join(leads, " and "))))
 	}
 
 	// Start battle loop
-	startBattle(firstPlayer, secondPlayer)
+	startBattle(players, rules, *format)
 }
 
+// activeSlots returns how many Pokémon each side has on the field in a format
+func activeSlots(format string) int {
+	if format == FormatDoubles {
+		return 2
+	}
+	return 1
+}
 
 
-// Authenticate the player using credentials from accounts.json
+
+// Authenticate the player against the registered accounts
 func authenticatePlayer(conn net.Conn) (string, bool) {
     buffer := make([]byte, 2048)
     n, err := conn.Read(buffer)
@@ -136,20 +331,16 @@ func authenticatePlayer(conn net.Conn) (string, bool) {
         return "", false
     }
 
-    accounts, err := loadAccountsData("../accounts.json")
+    ok, err := accounts.Login(authData["name"], authData["password"])
     if err != nil {
-        log.Printf("Failed to load accounts data: %v", err)
+        log.Printf("Failed to check account: %v", err)
         return "", false
     }
-
-    // Authenticate the user by iterating over all accounts
-    for _, account := range accounts {
-        if account.Username == authData["name"] && account.Password == authData["password"] {
-            response := map[string]string{"status": "success"}
-            responseBytes, _ := json.Marshal(response)
-            conn.Write(responseBytes)
-            return authData["name"], true
-        }
+    if ok {
+        response := map[string]string{"status": "success"}
+        responseBytes, _ := json.Marshal(response)
+        conn.Write(responseBytes)
+        return authData["name"], true
     }
 
     response := map[string]string{"status": "failure"}
@@ -160,62 +351,296 @@ func authenticatePlayer(conn net.Conn) (string, bool) {
 
 
 
-// Load accounts data from accounts.json
-func loadAccountsData(filename string) ([]Account, error) {
-    file, err := os.ReadFile(filename)
-    if err != nil {
-        return nil, fmt.Errorf("failed to load accounts data file: %v", err)
-    }
 
-    var accounts []Account
-    if err := json.Unmarshal(file, &accounts); err != nil {
-        return nil, fmt.Errorf("failed to parse accounts data: %v", err)
-    }
+// Load battle rules from the config file, filling in defaults for missing fields
+func loadRuleset(filename string) (*Ruleset, error) {
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rules file: %v", err)
+	}
+
+	rules := &Ruleset{TeamSize: 3}
+	if err := json.Unmarshal(file, rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file: %v", err)
+	}
+	if rules.TeamSize < 1 {
+		return nil, fmt.Errorf("team_size must be at least 1, got %d", rules.TeamSize)
+	}
+	if rules.LevelCap < 0 || rules.TurnTimerSeconds < 0 {
+		return nil, fmt.Errorf("level_cap and turn_timer_seconds cannot be negative")
+	}
+	if rules.NormalizeLevel && rules.LevelCap == 0 {
+		return nil, fmt.Errorf("normalize_level requires a level_cap")
+	}
+
+	log.Printf("Loaded battle rules from %s: %+v", filename, *rules)
+	return rules, nil
+}
+
+// Load ability and held item definitions
+func loadBattleEffects(abilitiesFile, itemsFile string) error {
+	file, err := os.ReadFile(abilitiesFile)
+	if err != nil {
+		return fmt.Errorf("failed to load abilities file: %v", err)
+	}
+	var abilityData AbilityData
+	if err := json.Unmarshal(file, &abilityData); err != nil {
+		return fmt.Errorf("failed to parse abilities file: %v", err)
+	}
+	for species, ability := range abilityData.Species {
+		if _, ok := abilityData.Abilities[ability]; !ok {
+			return fmt.Errorf("species %s has unknown ability %s", species, ability)
+		}
+	}
+
+	file, err = os.ReadFile(itemsFile)
+	if err != nil {
+		return fmt.Errorf("failed to load items file: %v", err)
+	}
+	if err := json.Unmarshal(file, &items); err != nil {
+		return fmt.Errorf("failed to parse items file: %v", err)
+	}
+
+	abilities = abilityData.Abilities
+	speciesAbilities = abilityData.Species
+	log.Printf("Loaded %d abilities and %d held items", len(abilities), len(items))
+	return nil
+}
+
+// describe summarizes the ruleset for players
+func (r *Ruleset) describe() string {
+	var b strings.Builder
+	b.WriteString("Battle rules:\n")
+	b.WriteString(fmt.Sprintf("- Team size: %d\n", r.TeamSize))
+	if r.LevelCap > 0 {
+		if r.NormalizeLevel {
+			b.WriteString(fmt.Sprintf("- All Pokémon battle at level %d\n", r.LevelCap))
+		} else {
+			b.WriteString(fmt.Sprintf("- Level cap: %d\n", r.LevelCap))
+		}
+	}
+	if len(r.BannedSpecies) > 0 {
+		b.WriteString(fmt.Sprintf("- Banned: %s\n", strings.Join(r.BannedSpecies, ", ")))
+	}
+	if r.SpeciesClause {
+		b.WriteString("- Species clause: no duplicate species\n")
+	}
+	if r.TurnTimerSeconds > 0 {
+		b.WriteString(fmt.Sprintf("- Turn timer: %d seconds\n", r.TurnTimerSeconds))
+	}
+	return b.String()
+}
+
+// checkPokemon reports why a single Pokémon may not be used under the ruleset
+func (r *Ruleset) checkPokemon(pokemon *Pokemon) error {
+	for _, banned := range r.BannedSpecies {
+		if strings.EqualFold(banned, pokemon.Name) || banned == pokemon.ID {
+			return fmt.Errorf("%s is banned", pokemon.Name)
+		}
+	}
+	if r.LevelCap > 0 && !r.NormalizeLevel && levelOf(pokemon) > r.LevelCap {
+		return fmt.Errorf("%s is level %d, above the level cap of %d", pokemon.Name, levelOf(pokemon), r.LevelCap)
+	}
+	return nil
+}
+
+// validateTeam checks a full team selection against the ruleset
+func (r *Ruleset) validateTeam(team []*Pokemon) error {
+	if len(team) != r.TeamSize {
+		return fmt.Errorf("please select exactly %d Pokémon, you selected %d", r.TeamSize, len(team))
+	}
+
+	seen := make(map[string]bool)
+	for _, pokemon := range team {
+		if err := r.checkPokemon(pokemon); err != nil {
+			return err
+		}
+		if r.SpeciesClause && seen[pokemon.ID] {
+			return fmt.Errorf("species clause: only one %s is allowed per team", pokemon.Name)
+		}
+		seen[pokemon.ID] = true
+	}
+	return nil
+}
+
+// applyLevel sets the level a Pokémon battles at, its own or LevelCap when levels are normalized,
+// and scales its stats from StatsLevel to it
+func (r *Ruleset) applyLevel(pokemon *Pokemon) {
+	level := levelOf(pokemon)
+	if r.NormalizeLevel {
+		level = r.LevelCap
+	}
+	scale := func(stat int) int {
+		return stat * level / StatsLevel
+	}
+	pokemon.Stats = Stats{
+		HP:      max(scale(pokemon.Stats.HP), 1),
+		Attack:  scale(pokemon.Stats.Attack),
+		Defense: scale(pokemon.Stats.Defense),
+		Speed:   scale(pokemon.Stats.Speed),
+		SpAtk:   scale(pokemon.Stats.SpAtk),
+		SpDef:   scale(pokemon.Stats.SpDef),
+	}
+	pokemon.Level = level
+}
+
+// levelOf returns a Pokémon's level, treating unset levels as DefaultLevel
+func levelOf(pokemon *Pokemon) int {
+	if pokemon.Level <= 0 {
+		return DefaultLevel
+	}
+	return pokemon.Level
+}
 
-    log.Printf("Loaded %d accounts from %s", len(accounts), filename)
-    return accounts, nil
+// Load nature definitions
+func loadNatures(filename string) error {
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to load natures file: %v", err)
+	}
+	if err := json.Unmarshal(file, &natures); err != nil {
+		return fmt.Errorf("failed to parse natures file: %v", err)
+	}
+	return nil
 }
 
+// applyIndividuals adds a Pokémon's individual values and nature to the Pokédex stats it was saved with.
+// Pokémon caught before individual values existed keep their Pokédex stats.
+func applyIndividuals(pokemon *Pokemon) {
+	stats := map[string]*int{
+		"HP":      &pokemon.Stats.HP,
+		"Attack":  &pokemon.Stats.Attack,
+		"Defense": &pokemon.Stats.Defense,
+		"Speed":   &pokemon.Stats.Speed,
+		"Sp Atk":  &pokemon.Stats.SpAtk,
+		"Sp Def":  &pokemon.Stats.SpDef,
+	}
+	nature := natures[pokemon.Nature]
+	for name, stat := range stats {
+		// At the level Pokédex stats describe, each individual value point is worth half a stat point
+		*stat += pokemon.IVs[name] / 2
+		switch name {
+		case nature.Increased:
+			*stat = int(float64(*stat) * natureBoost)
+		case nature.Decreased:
+			*stat = int(float64(*stat) * natureDrop)
+		}
+	}
+}
+
+// settleBattle pays both players and takes the potions they used out of their saved inventories.
+// The loser of a battle that was played out is paid too; one who left part way is not.
+func settleBattle(winner, loser *Player, finished bool) {
+	earnings := map[*Player]int{winner: shop.Rewards.PokebatWin, loser: 0}
+	if finished {
+		earnings[loser] = shop.Rewards.PokebatLoss
+	}
 
+	err := playerStore.Update(func(playerDatas []store.Record) ([]store.Record, error) {
+		for _, playerData := range playerDatas {
+			for player, earned := range earnings {
+				if playerData["player_name"] != player.Name {
+					continue
+				}
+				money, inventory, err := shop.WalletOf(playerData)
+				if err != nil {
+					return nil, err
+				}
+				for key, used := range player.Used {
+					inventory[key] = max(inventory[key]-used, 0)
+				}
+				playerData["money"], playerData["inventory"] = money+earned, inventory
+			}
+		}
+		return playerDatas, nil
+	})
+	if err != nil {
+		log.Printf("Failed to save battle rewards: %v", err)
+		return
+	}
+	for player, earned := range earnings {
+		if earned > 0 {
+			player.Conn.Write([]byte(fmt.Sprintf("You earned ₽%d.\n", earned)))
+		}
+	}
+}
+
+// recordBattle saves the battle to the battle log, if there is one, and tells both players their new rating.
+// A loser who left part way loses rating like any other loser.
+func recordBattle(winner, loser *Player, format string, finished bool) {
+	if battleLog == nil {
+		return
+	}
+	winnerRating, loserRating, err := battleLog.RecordBattle(store.Battle{
+		Winner:   winner.Name,
+		Loser:    loser.Name,
+		Format:   format,
+		Finished: finished,
+		PlayedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record battle: %v", err)
+		return
+	}
+	winner.Conn.Write([]byte(fmt.Sprintf("Your rating is now %d.\n", winnerRating)))
+	loser.Conn.Write([]byte(fmt.Sprintf("Your rating is now %d.\n", loserRating)))
+}
 
-// Load player data from player_data.json
-func loadPlayerData(filename, playerName string) (*Player, error) {
-    file, err := os.ReadFile(filename)
+// Load player data from the player store
+func loadPlayerData(players store.Store, playerName string) (*Player, error) {
+    playerData, err := store.Player(players, playerName)
     if err != nil {
-        return nil, fmt.Errorf("failed to load player_data.json: %v", err)
+        return nil, err
     }
-
-    var playerDatas []map[string]interface{}
-    if err := json.Unmarshal(file, &playerDatas); err != nil {
-        return nil, fmt.Errorf("failed to parse player_data.json: %v", err)
+    if playerData == nil {
+        return nil, fmt.Errorf("player data not found for player_name: %s", playerName)
     }
 
-    // Look for the player data based on player_name
-    for _, playerData := range playerDatas {
-        if playerData["player_name"] == playerName {
-            // Parse the Pokémon data
-            pokemonsData, _ := json.Marshal(playerData["pokemons"])
-            var pokemons []*Pokemon
-            if err := json.Unmarshal(pokemonsData, &pokemons); err != nil {
-                return nil, fmt.Errorf("failed to parse pokemons data: %v", err)
-            }
-
-            return &Player{
-                Name:     playerName,
-                Pokemons: pokemons,
-                Active:   pokemons[0], // Set the first Pokémon as active
-            }, nil
+    // Parse the Pokémon data
+    pokemonsData, _ := json.Marshal(playerData["pokemons"])
+    var pokemons []*Pokemon
+    if err := json.Unmarshal(pokemonsData, &pokemons); err != nil {
+        return nil, fmt.Errorf("failed to parse pokemons data: %v", err)
+    }
+    for _, pokemon := range pokemons {
+        if pokemon.Ability == "" {
+            pokemon.Ability = speciesAbilities[pokemon.Name]
         }
+        applyIndividuals(pokemon)
+    }
+
+    // Parse the saved team presets, if any
+    teamsData, _ := json.Marshal(playerData["teams"])
+    var teams []TeamPreset
+    if err := json.Unmarshal(teamsData, &teams); err != nil {
+        return nil, fmt.Errorf("failed to parse teams data: %v", err)
     }
 
-    return nil, fmt.Errorf("player data not found for player_name: %s", playerName)
+    _, inventory, err := shop.WalletOf(playerData)
+    if err != nil {
+        return nil, err
+    }
+
+    return &Player{
+        Name:      playerName,
+        Pokemons:  pokemons,
+        Teams:     teams,
+        Inventory: inventory,
+        Used:      make(map[string]int),
+    }, nil
 }
 
-func selectPokemons(player *Player) {
-	if len(player.Pokemons) < 3 {
-		player.Conn.Write([]byte("You need at least 3 Pokémon to battle. Please play PokéCat to catch more Pokémon.\n"))
-		player.Conn.Close()
-		return
+// selectPokemons lets the player pick a team that satisfies the ruleset
+func selectPokemons(player *Player, rules *Ruleset, slots int) error {
+	eligible := 0
+	for _, pokemon := range player.Pokemons {
+		if rules.checkPokemon(pokemon) == nil {
+			eligible++
+		}
+	}
+	if eligible < rules.TeamSize {
+		player.Conn.Write([]byte(fmt.Sprintf("You need at least %d Pokémon allowed by the battle rules, but only %d of yours are. Please play PokéCat to catch more Pokémon.\n", rules.TeamSize, eligible)))
+		return fmt.Errorf("%s has %d eligible Pokémon, %d required", player.Name, eligible, rules.TeamSize)
 	}
 
 	for {
@@ -232,96 +657,545 @@ func selectPokemons(player *Player) {
 			spAtkBar := strings.Repeat("🟩", int(math.Ceil(float64(pokemon.Stats.SpAtk)/10)))
 			spDefBar := strings.Repeat("🟩", int(math.Ceil(float64(pokemon.Stats.SpDef)/10)))
 
+			// Mark Pokémon the rules do not allow
+			restriction := ""
+			if err := rules.checkPokemon(pokemon); err != nil {
+				restriction = fmt.Sprintf("⛔ Not allowed: %v\n", err)
+			}
+
+			// Nicknames and catch dates tell apart several Pokémon of the same species
+			name := pokemon.Name
+			if pokemon.Nickname != "" {
+				name = fmt.Sprintf("%s the %s", pokemon.Nickname, pokemon.Name)
+			}
+			if len(pokemon.CaughtAt) >= len("2006-01-02") {
+				name += fmt.Sprintf(", caught %s", pokemon.CaughtAt[:len("2006-01-02")])
+			}
+
 			// Send the formatted Pokémon details to the player
 			player.Conn.Write([]byte(fmt.Sprintf(
-				"%d. %s (ID: %s)\nType: %s\nHP:      %s\nAttack:  %s\nDefense: %s\nSpeed:   %s\nSp Atk:  %s\nSp Def:  %s\n\n",
-				i+1, pokemon.Name, pokemon.ID, types, hpBar, attackBar, defenseBar, speedBar, spAtkBar, spDefBar,
+				"%d. %s (ID: %s, Lv. %d)\nType: %s\nAbility: %s | Held item: %s | Nature: %s\nHP:      %s\nAttack:  %s\nDefense: %s\nSpeed:   %s\nSp Atk:  %s\nSp Def:  %s\n%s\n",
+				i+1, name, pokemon.ID, levelOf(pokemon), types, sourceName(abilities, pokemon.Ability), sourceName(items, pokemon.HeldItem), natureName(pokemon.Nature),
+				hpBar, attackBar, defenseBar, speedBar, spAtkBar, spDefBar, restriction,
 			)))
 		}
-		player.Conn.Write([]byte("Choose 3 Pokémon by entering their numbers (separated by space): "))
-		choice := make([]byte, 1024)
-		n, err := player.Conn.Read(choice)
+		prompt := fmt.Sprintf("Choose %d Pokémon by entering their numbers (separated by space): ", rules.TeamSize)
+		if len(player.Teams) > 0 {
+			player.Conn.Write([]byte("Your saved teams:\n"))
+			for _, team := range player.Teams {
+				player.Conn.Write([]byte(fmt.Sprintf("- %s\n", team.Name)))
+			}
+			prompt = fmt.Sprintf("Choose %d Pokémon by entering their numbers (separated by space), or enter a saved team name: ", rules.TeamSize)
+		}
+		player.Conn.Write([]byte(prompt))
+		choice, err := readChoice(player)
 		if err != nil {
-			log.Printf("Failed to read Pokémon choice: %v", err)
+			return fmt.Errorf("failed to read Pokémon choice: %v", err)
+		}
+
+		var selectedPokemons []*Pokemon
+		if team := findTeam(player, choice); team != nil {
+			selectedPokemons, err = resolveTeam(player, team)
+		} else {
+			selectedPokemons, err = parseTeamSelection(player, strings.Fields(choice))
+		}
+		if err == nil {
+			err = rules.validateTeam(selectedPokemons)
+		}
+		if err != nil {
+			player.Conn.Write([]byte(fmt.Sprintf("Invalid team: %v. Please try again.\n", err)))
 			continue
 		}
-		choices := strings.Fields(string(choice[:n]))
 
-		if len(choices) != 3 {
-			player.Conn.Write([]byte("Invalid Pokémon selection. Please select exactly 3 Pokémon.\n"))
+		for _, pokemon := range selectedPokemons {
+			rules.applyLevel(pokemon)
+			pokemon.MaxHP = pokemon.Stats.HP
+		}
+		player.Pokemons = selectedPokemons
+		player.Actives = append([]*Pokemon(nil), player.Pokemons[:slots]...) // Lead with the first picks
+		return nil
+	}
+}
+
+// sendTeamPreview shows a player the species and types of every Pokémon the opponent may bring
+func sendTeamPreview(player, opponent *Player, rules *Ruleset) {
+	player.Conn.Write([]byte(fmt.Sprintf("Team preview: %s may choose from\n", opponent.Name)))
+	for _, pokemon := range opponent.Pokemons {
+		if rules.checkPokemon(pokemon) != nil {
 			continue
 		}
+		player.Conn.Write([]byte(fmt.Sprintf("- %s [%s]\n", pokemon.Name, strings.ToUpper(strings.Join(pokemon.Types, ", ")))))
+	}
+	player.Conn.Write([]byte("\n"))
+}
 
-		// Clear previous Pokémon selections
-		selectedPokemons := make([]*Pokemon, 0, 3)
+// findTeam looks up a saved team by name, ignoring case
+func findTeam(player *Player, name string) *TeamPreset {
+	for i := range player.Teams {
+		if strings.EqualFold(player.Teams[i].Name, name) {
+			return &player.Teams[i]
+		}
+	}
+	return nil
+}
 
-		// Check if the selected Pokémon numbers are valid
-		validSelection := true
-		for _, choiceNum := range choices {
-			index, err := strconv.Atoi(choiceNum)
-			if err != nil || index < 1 || index > len(player.Pokemons) {
-				player.Conn.Write([]byte(fmt.Sprintf("Invalid choice number: %s. Please try again.\n", choiceNum)))
-				validSelection = false
+// resolveTeam maps a saved team onto the Pokémon the player currently owns
+func resolveTeam(player *Player, team *TeamPreset) ([]*Pokemon, error) {
+	selected := make([]*Pokemon, 0, len(team.PokemonIDs))
+	for _, id := range team.PokemonIDs {
+		var found *Pokemon
+		for _, pokemon := range player.Pokemons {
+			if instanceID(pokemon) == id {
+				found = pokemon
 				break
 			}
-			selectedPokemons = append(selectedPokemons, player.Pokemons[index-1])
 		}
+		if found == nil {
+			return nil, fmt.Errorf("team %s includes Pokémon #%s, which you no longer own", team.Name, id)
+		}
+		for _, pokemon := range selected {
+			if pokemon == found {
+				return nil, fmt.Errorf("team %s lists %s more than once", team.Name, found.Name)
+			}
+		}
+		selected = append(selected, found)
+	}
+	return selected, nil
+}
 
-		if validSelection {
-			player.Pokemons = selectedPokemons
-			player.Active = player.Pokemons[0] // Set the first Pokémon as active
-			break
+// natureName is the display name of a nature, or "None" for Pokémon caught before natures existed
+func natureName(key string) string {
+	if nature, ok := natures[key]; ok {
+		return nature.Name
+	}
+	return "None"
+}
+
+// instanceID identifies one of a player's Pokémon. Records saved before every catch had its own
+// instance ID held one Pokémon per species, so those fall back to the species ID.
+func instanceID(pokemon *Pokemon) string {
+	if pokemon.InstanceID != "" {
+		return pokemon.InstanceID
+	}
+	return pokemon.ID
+}
+
+// parseTeamSelection turns the numbers typed by a player into the chosen Pokémon
+func parseTeamSelection(player *Player, choices []string) ([]*Pokemon, error) {
+	selected := make([]*Pokemon, 0, len(choices))
+	picked := make(map[int]bool)
+	for _, choiceNum := range choices {
+		index, err := strconv.Atoi(choiceNum)
+		if err != nil || index < 1 || index > len(player.Pokemons) {
+			return nil, fmt.Errorf("%q is not a number between 1 and %d", choiceNum, len(player.Pokemons))
 		}
+		if picked[index] {
+			return nil, fmt.Errorf("Pokémon number %d was chosen more than once", index)
+		}
+		picked[index] = true
+		selected = append(selected, player.Pokemons[index-1])
 	}
+	return selected, nil
 }
 
 
 // Start battle between players
-func startBattle(firstPlayer, secondPlayer *Player) {
-    firstPlayer.Conn.Write([]byte(fmt.Sprintf("%s, prepare for battle!\n", firstPlayer.Name)))
-    secondPlayer.Conn.Write([]byte(fmt.Sprintf("%s, prepare for battle!\n", secondPlayer.Name)))
-    rand.New(rand.NewSource(time.Now().UnixNano()))
-
-    for {
-        for _, player := range []*Player{firstPlayer, secondPlayer} {
-            player.Conn.Write([]byte(fmt.Sprintf("Active Pokémon: %s\n", player.Active.Name)))
-            player.Conn.Write([]byte("Choose action:\n1. Attack\n2. Switch Pokémon\nEnter your choice: "))
-
-            choice := make([]byte, 1024)
-            n, err := player.Conn.Read(choice)
-            if err != nil {
-                log.Printf("Failed to read player choice: %v", err)
-                continue
-            }
-
-            switch strings.TrimSpace(string(choice[:n])) {
-            case "1":
-                element := player.Active.Types[0]
-                damage, attackType := calculateDamage(player.Active, secondPlayer.Active, element)
-                secondPlayer.Active.Stats.HP -= damage
-
-                player.Conn.Write([]byte(fmt.Sprintf("You used a %s attack! Damage dealt: %d\n", attackType, damage)))
-                secondPlayer.Conn.Write([]byte(fmt.Sprintf("You received a %s attack! Damage taken: %d\n", attackType, damage)))
-
-                if secondPlayer.Active.Stats.HP <= 0 {
-                    secondPlayer.Conn.Write([]byte("Your Pokémon fainted!\n"))
-                    if allPokemonFainted(secondPlayer) {
-                        player.Conn.Write([]byte("You win!\n"))
-                        secondPlayer.Conn.Write([]byte("You lose!\n"))
-                        return
-                    }
-                    switchPokemon(secondPlayer)
-                }
-            case "2":
-                switchPokemon(player)
-            default:
-                player.Conn.Write([]byte("Invalid choice. Try again.\n"))
-            }
-
-            // Switch turns
-            firstPlayer, secondPlayer = secondPlayer, firstPlayer
-        }
-    }
+func startBattle(players []*Player, rules *Ruleset, format string) {
+	for _, player := range players {
+		player.Conn.Write([]byte(fmt.Sprintf("%s, prepare for %s battle!\n", player.Name, format)))
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// Leads trigger their switch-in effects once both sides are on the field
+	for i, player := range players {
+		for _, active := range player.Actives {
+			switchIn(player, players[1-i], active)
+		}
+	}
+
+	for {
+		// Every active Pokémon on both sides picks an action before anything happens
+		var actions []*Action
+		for i, player := range players {
+			foe := players[1-i]
+			for slot, active := range player.Actives {
+				if active == nil {
+					continue
+				}
+				action, err := chooseAction(player, foe, slot, rules, format)
+				if err != nil {
+					log.Printf("Failed to read player choice: %v", err)
+					foe.Conn.Write([]byte(fmt.Sprintf("%s left the battle. You win!\n", player.Name)))
+					settleBattle(foe, player, false)
+					recordBattle(foe, player, format, false)
+					return
+				}
+				actions = append(actions, action)
+			}
+		}
+
+		orderActions(actions, rng)
+		for _, action := range actions {
+			if winner := executeAction(action); winner != nil {
+				loser := action.Foe
+				if winner == loser {
+					loser = action.Player
+				}
+				winner.Conn.Write([]byte("You win!\n"))
+				loser.Conn.Write([]byte("You lose!\n"))
+				settleBattle(winner, loser, true)
+				recordBattle(winner, loser, format, true)
+				return
+			}
+		}
+		endOfTurn(players)
+	}
+}
+
+// readChoice reads one trimmed line of input from a player
+func readChoice(player *Player) (string, error) {
+	choice := make([]byte, 1024)
+	n, err := player.Conn.Read(choice)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(choice[:n])), nil
+}
+
+// chooseAction asks a player what the Pokémon in the given slot should do this turn.
+// When the turn timer runs out the Pokémon attacks the first foe on the field.
+func chooseAction(player, foe *Player, slot int, rules *Ruleset, format string) (*Action, error) {
+	active := player.Actives[slot]
+	if rules.TurnTimerSeconds > 0 {
+		player.Conn.SetReadDeadline(time.Now().Add(time.Duration(rules.TurnTimerSeconds) * time.Second))
+		defer player.Conn.SetReadDeadline(time.Time{})
+		player.Conn.Write([]byte(fmt.Sprintf("You have %d seconds to choose.\n", rules.TurnTimerSeconds)))
+	}
+
+	for {
+		player.Conn.Write([]byte(fmt.Sprintf("Active Pokémon: %s (HP: %d)\n", active.Name, active.Stats.HP)))
+		if format == FormatDoubles {
+			player.Conn.Write([]byte("Choose action:\n1. Attack\n2. Switch Pokémon\n3. Spread attack (hits both foes)\n4. Use a potion\nEnter your choice: "))
+		} else {
+			player.Conn.Write([]byte("Choose action:\n1. Attack\n2. Switch Pokémon\n3. Use a potion\nEnter your choice: "))
+		}
+
+		choice, err := readChoice(player)
+		if isTimeout(err) {
+			player.Conn.Write([]byte("\nTime's up! Your Pokémon attacks on its own.\n"))
+			target, _ := firstActiveSlot(foe)
+			return &Action{Player: player, Foe: foe, Pokemon: active, Slot: slot, Kind: "attack", Target: target}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		action := &Action{Player: player, Foe: foe, Pokemon: active, Slot: slot}
+		switch {
+		case choice == "1":
+			target, ok := chooseTarget(player, foe)
+			if !ok {
+				continue
+			}
+			action.Kind = "attack"
+			action.Target = target
+		case choice == "2":
+			switchTo := choosePokemonToSwitch(player)
+			if switchTo == nil {
+				continue
+			}
+			action.Kind = "switch"
+			action.SwitchTo = switchTo
+		case choice == "3" && format == FormatDoubles:
+			action.Kind = "spread"
+		case choice == "4" && format == FormatDoubles, choice == "3" && format == FormatSingles:
+			item := choosePotion(player, active)
+			if item == "" {
+				continue
+			}
+			action.Kind = "potion"
+			action.Item = item
+		default:
+			player.Conn.Write([]byte("Invalid choice. Try again.\n"))
+			continue
+		}
+		return action, nil
+	}
+}
+
+// chooseTarget asks which foe to attack, skipping the question when only one foe is on the field
+func chooseTarget(player, foe *Player) (int, bool) {
+	var targets []int
+	for slot, pokemon := range foe.Actives {
+		if pokemon != nil {
+			targets = append(targets, slot)
+		}
+	}
+	if len(targets) == 1 {
+		return targets[0], true
+	}
+
+	player.Conn.Write([]byte("Choose a target:\n"))
+	for _, slot := range targets {
+		player.Conn.Write([]byte(fmt.Sprintf("%d. %s\n", slot+1, foe.Actives[slot].Name)))
+	}
+	choice, err := readChoice(player)
+	if isTimeout(err) {
+		return firstActiveSlot(foe)
+	}
+	if err != nil {
+		log.Printf("Failed to read target choice: %v", err)
+		return 0, false
+	}
+	index, err := strconv.Atoi(choice)
+	if err != nil || index < 1 || index > len(foe.Actives) || foe.Actives[index-1] == nil {
+		player.Conn.Write([]byte("Invalid target. Try again.\n"))
+		return 0, false
+	}
+	return index - 1, true
+}
+
+// orderActions sorts actions so switches and potions go first, then faster Pokémon, with ties broken randomly
+func orderActions(actions []*Action, rng *rand.Rand) {
+	rng.Shuffle(len(actions), func(i, j int) { actions[i], actions[j] = actions[j], actions[i] })
+	sort.SliceStable(actions, func(i, j int) bool {
+		a, b := actions[i], actions[j]
+		if a.goesFirst() != b.goesFirst() {
+			return a.goesFirst()
+		}
+		return a.Pokemon.Stats.Speed > b.Pokemon.Stats.Speed
+	})
+}
+
+// goesFirst reports whether an action happens before any attack
+func (a *Action) goesFirst() bool {
+	return a.Kind == "switch" || a.Kind == "potion"
+}
+
+// executeAction carries out an action and returns the winning player once one side has no Pokémon left
+func executeAction(action *Action) *Player {
+	player, foe := action.Player, action.Foe
+	attacker := action.Pokemon
+	if player.Actives[action.Slot] != attacker {
+		if action.Kind == "potion" {
+			player.Inventory[action.Item]++ // Give back the potion it had set aside
+		}
+		return nil // Fainted or was replaced before it could move
+	}
+
+	switch action.Kind {
+	case "switch":
+		if action.SwitchTo.Stats.HP <= 0 || isActive(player, action.SwitchTo) {
+			return nil
+		}
+		player.Actives[action.Slot] = action.SwitchTo
+		player.Conn.Write([]byte(fmt.Sprintf("Switched to %s\n", action.SwitchTo.Name)))
+		foe.Conn.Write([]byte(fmt.Sprintf("%s sent out %s!\n", player.Name, action.SwitchTo.Name)))
+		switchIn(player, foe, action.SwitchTo)
+	case "potion":
+		potion := shop.Items[action.Item]
+		healed := min(potion.Heal, attacker.MaxHP-attacker.Stats.HP)
+		attacker.Stats.HP += healed
+		player.Used[action.Item]++
+		announce(player, foe, fmt.Sprintf("%s used a %s! %s recovered %d HP (HP: %d).\n",
+			player.Name, potion.Name, attacker.Name, healed, attacker.Stats.HP))
+	case "attack":
+		target := action.Target
+		if foe.Actives[target] == nil {
+			// The chosen target is gone, so redirect to whichever foe is left
+			var ok bool
+			if target, ok = firstActiveSlot(foe); !ok {
+				return nil
+			}
+		}
+		return hitTarget(player, foe, action.Slot, target, 1.0)
+	case "spread":
+		for slot, pokemon := range foe.Actives {
+			if pokemon == nil {
+				continue
+			}
+			if winner := hitTarget(player, foe, action.Slot, slot, spreadDamageMultiplier); winner != nil {
+				return winner
+			}
+			if player.Actives[action.Slot] != attacker {
+				break // The attacker fainted part way through
+			}
+		}
+	}
+	return nil
+}
+
+// hitTarget applies one attack from an attacker slot to a foe slot and handles fainting on both sides
+func hitTarget(player, foe *Player, attackerSlot, slot int, multiplier float64) *Player {
+	attacker := player.Actives[attackerSlot]
+	defender := foe.Actives[slot]
+	element := attacker.Types[0]
+	damage, attackType := calculateDamage(attacker, defender, element)
+	damage = int(float64(damage) * multiplier)
+	damage = beforeDamage(player, foe, attacker, defender, element, damage)
+	defender.Stats.HP -= damage
+
+	player.Conn.Write([]byte(fmt.Sprintf("%s used a %s attack on %s! Damage dealt: %d\n", attacker.Name, attackType, defender.Name, damage)))
+	foe.Conn.Write([]byte(fmt.Sprintf("%s received a %s attack! Damage taken: %d\n", defender.Name, attackType, damage)))
+	afterDamage(player, foe, attacker, defender, damage, attackType)
+
+	if defender.Stats.HP <= 0 {
+		foe.Conn.Write([]byte(fmt.Sprintf("Your %s fainted!\n", defender.Name)))
+		player.Conn.Write([]byte(fmt.Sprintf("The opposing %s fainted!\n", defender.Name)))
+		if allPokemonFainted(foe) {
+			return player
+		}
+		replaceFainted(foe, player, slot)
+	}
+	if attacker.Stats.HP <= 0 {
+		player.Conn.Write([]byte(fmt.Sprintf("Your %s fainted!\n", attacker.Name)))
+		foe.Conn.Write([]byte(fmt.Sprintf("The opposing %s fainted!\n", attacker.Name)))
+		if allPokemonFainted(player) {
+			return foe
+		}
+		replaceFainted(player, foe, attackerSlot)
+	}
+	return nil
+}
+
+// effectsAt returns the ability and held item effects of a Pokémon that run at a hook
+func effectsAt(pokemon *Pokemon, hook string) []triggeredEffect {
+	var sources []EffectSource
+	if ability, ok := abilities[pokemon.Ability]; ok {
+		sources = append(sources, ability)
+	}
+	if item, ok := items[pokemon.HeldItem]; ok {
+		sources = append(sources, item)
+	}
+
+	var triggered []triggeredEffect
+	for _, source := range sources {
+		for _, effect := range source.Effects {
+			if effect.Hook != hook {
+				continue
+			}
+			if effect.BelowHP > 0 && float64(pokemon.Stats.HP) > effect.BelowHP*float64(pokemon.MaxHP) {
+				continue
+			}
+			triggered = append(triggered, triggeredEffect{Source: source.Name, Effect: effect})
+		}
+	}
+	return triggered
+}
+
+// triggeredEffect is an effect paired with the name of the ability or item it came from
+type triggeredEffect struct {
+	Source string
+	Effect
+}
+
+// switchIn runs the switch-in effects of a Pokémon that just entered the field
+func switchIn(player, foe *Player, pokemon *Pokemon) {
+	for _, effect := range effectsAt(pokemon, HookSwitchIn) {
+		if effect.Kind != "lower_foe_stat" {
+			continue
+		}
+		for _, target := range foe.Actives {
+			if target == nil {
+				continue
+			}
+			if stat := statByName(&target.Stats, effect.Stat); stat != nil {
+				*stat = int(float64(*stat) * effect.Multiplier)
+				announce(player, foe, fmt.Sprintf("%s's %s lowered %s's %s!\n", pokemon.Name, effect.Source, target.Name, effect.Stat))
+			}
+		}
+	}
+}
+
+// beforeDamage adjusts the damage of an attack using the attacker's and defender's effects
+func beforeDamage(player, foe *Player, attacker, defender *Pokemon, element string, damage int) int {
+	multiplier := 1.0
+	for _, effect := range effectsAt(attacker, HookBeforeDamage) {
+		if effect.Kind == "boost_attack" && (effect.Type == "" || effect.Type == element) {
+			multiplier *= effect.Multiplier
+		}
+	}
+	for _, effect := range effectsAt(defender, HookBeforeDamage) {
+		if effect.Kind == "reduce_damage" && (effect.Type == "" || effect.Type == element) {
+			multiplier *= effect.Multiplier
+			if effect.Multiplier == 0 {
+				announce(player, foe, fmt.Sprintf("%s's %s makes it immune to %s attacks!\n", defender.Name, effect.Source, element))
+			} else {
+				announce(player, foe, fmt.Sprintf("%s's %s weakened the attack!\n", defender.Name, effect.Source))
+			}
+		}
+	}
+	return int(float64(damage) * multiplier)
+}
+
+// afterDamage runs effects that react to an attack landing, such as recoil
+func afterDamage(player, foe *Player, attacker, defender *Pokemon, damage int, attackType string) {
+	for _, effect := range effectsAt(attacker, HookAfterDamage) {
+		if effect.Kind == "recoil" && damage > 0 {
+			loss := max(int(effect.Fraction*float64(attacker.MaxHP)), 1)
+			attacker.Stats.HP -= loss
+			announce(player, foe, fmt.Sprintf("%s lost %d HP to its %s.\n", attacker.Name, loss, effect.Source))
+		}
+	}
+	for _, effect := range effectsAt(defender, HookAfterDamage) {
+		if effect.Kind == "punish_contact" && attackType == "normal" {
+			loss := max(int(effect.Fraction*float64(attacker.MaxHP)), 1)
+			attacker.Stats.HP -= loss
+			announce(player, foe, fmt.Sprintf("%s was hurt by %s's %s! (-%d HP)\n", attacker.Name, defender.Name, effect.Source, loss))
+		}
+	}
+}
+
+// endOfTurn runs end-of-turn effects, such as healing, for every Pokémon on the field
+func endOfTurn(players []*Player) {
+	for i, player := range players {
+		for _, pokemon := range player.Actives {
+			if pokemon == nil {
+				continue
+			}
+			for _, effect := range effectsAt(pokemon, HookEndOfTurn) {
+				if effect.Kind != "heal" || pokemon.Stats.HP >= pokemon.MaxHP {
+					continue
+				}
+				heal := min(max(int(effect.Fraction*float64(pokemon.MaxHP)), 1), pokemon.MaxHP-pokemon.Stats.HP)
+				pokemon.Stats.HP += heal
+				announce(player, players[1-i], fmt.Sprintf("%s restored %d HP with its %s.\n", pokemon.Name, heal, effect.Source))
+			}
+		}
+	}
+}
+
+// statByName returns a pointer to the stat with the given pokedex name
+func statByName(stats *Stats, name string) *int {
+	switch name {
+	case "HP":
+		return &stats.HP
+	case "Attack":
+		return &stats.Attack
+	case "Defense":
+		return &stats.Defense
+	case "Speed":
+		return &stats.Speed
+	case "Sp Atk":
+		return &stats.SpAtk
+	case "Sp Def":
+		return &stats.SpDef
+	}
+	return nil
+}
+
+// sourceName returns the display name of an ability or item key
+func sourceName(sources map[string]EffectSource, key string) string {
+	if source, ok := sources[key]; ok {
+		return source.Name
+	}
+	return "None"
+}
+
+// announce sends the same message to both players
+func announce(player, foe *Player, message string) {
+	player.Conn.Write([]byte(message))
+	foe.Conn.Write([]byte(message))
 }
 
 func calculateDamage(attacker, defender *Pokemon, element string) (int, string) {
@@ -362,30 +1236,136 @@ func getElementalMultiplier(element string, multipliers map[string]string) float
 	return multiplier
 }
 
-func switchPokemon(player *Player) {
+// choosePokemonToSwitch asks the player for a benched Pokémon, returning nil if none can come in
+func choosePokemonToSwitch(player *Player) *Pokemon {
+	available := false
 	player.Conn.Write([]byte("Choose a Pokémon to switch to:\n"))
 	for i, pokemon := range player.Pokemons {
-		if pokemon != player.Active && pokemon.Stats.HP > 0 {
+		if !isActive(player, pokemon) && pokemon.Stats.HP > 0 {
 			player.Conn.Write([]byte(fmt.Sprintf("%d. %s\n", i+1, pokemon.Name)))
+			available = true
 		}
 	}
+	if !available {
+		player.Conn.Write([]byte("No Pokémon available to switch in.\n"))
+		return nil
+	}
 
-	choice := make([]byte, 1024)
-	n, err := player.Conn.Read(choice)
-	if err != nil {
-		log.Printf("Failed to read Pokémon switch choice: %v", err)
-		return
+	for {
+		choice, err := readChoice(player)
+		if err != nil {
+			log.Printf("Failed to read Pokémon switch choice: %v", err)
+			return nil
+		}
+
+		selectedIndex, err := strconv.Atoi(choice)
+		if err != nil || selectedIndex < 1 || selectedIndex > len(player.Pokemons) {
+			player.Conn.Write([]byte("Invalid choice. Try again.\n"))
+			continue
+		}
+		selected := player.Pokemons[selectedIndex-1]
+		if isActive(player, selected) || selected.Stats.HP <= 0 {
+			player.Conn.Write([]byte("Invalid choice. Try again.\n"))
+			continue
+		}
+		return selected
+	}
+}
+
+// choosePotion asks which potion to use on an active Pokémon, returning "" if the player has none or backs out.
+// The chosen potion is taken out of the inventory right away, so in doubles the other active Pokémon
+// cannot choose the same last one; executeAction gives it back if it goes unused.
+func choosePotion(player *Player, active *Pokemon) string {
+	if active.Stats.HP >= active.MaxHP {
+		player.Conn.Write([]byte(fmt.Sprintf("%s's HP is already full.\n", active.Name)))
+		return ""
 	}
+	var potions []string
+	for key, count := range player.Inventory {
+		if shop.Items[key].Kind == "potion" && count > 0 {
+			potions = append(potions, key)
+		}
+	}
+	if len(potions) == 0 {
+		player.Conn.Write([]byte("You have no potions. Buy some at the hub's shop.\n"))
+		return ""
+	}
+	sort.Slice(potions, func(i, j int) bool { return shop.Items[potions[i]].Heal < shop.Items[potions[j]].Heal })
 
-	selectedIndex, err := strconv.Atoi(strings.TrimSpace(string(choice[:n])))
-	if err != nil || selectedIndex < 1 || selectedIndex > len(player.Pokemons) || player.Pokemons[selectedIndex-1] == player.Active {
+	player.Conn.Write([]byte("Choose a potion (or 0 to go back):\n"))
+	for i, key := range potions {
+		item := shop.Items[key]
+		player.Conn.Write([]byte(fmt.Sprintf("%d. %s (restores %d HP, %d left)\n", i+1, item.Name, item.Heal, player.Inventory[key])))
+	}
+	choice, err := readChoice(player)
+	if err != nil {
+		log.Printf("Failed to read potion choice: %v", err)
+		return ""
+	}
+	index, err := strconv.Atoi(choice)
+	if err != nil || index < 0 || index > len(potions) {
 		player.Conn.Write([]byte("Invalid choice. Try again.\n"))
-		switchPokemon(player)
-		return
+		return ""
+	}
+	if index == 0 {
+		return ""
 	}
+	key := potions[index-1]
+	player.Inventory[key]--
+	return key
+}
 
-	player.Active = player.Pokemons[selectedIndex-1]
-	player.Conn.Write([]byte(fmt.Sprintf("Switched to %s\n", player.Active.Name)))
+// replaceFainted fills a slot whose Pokémon fainted, leaving it empty when the bench is exhausted.
+// If the player's choice cannot be read, for example because they disconnected, the first healthy
+// benched Pokémon goes in, so the battle still has a target and ends when their next action fails.
+func replaceFainted(player, foe *Player, slot int) {
+	player.Actives[slot] = nil
+	switchTo := choosePokemonToSwitch(player)
+	if switchTo == nil {
+		switchTo = firstHealthyBench(player)
+	}
+	if switchTo != nil {
+		player.Actives[slot] = switchTo
+		player.Conn.Write([]byte(fmt.Sprintf("Switched to %s\n", switchTo.Name)))
+		foe.Conn.Write([]byte(fmt.Sprintf("%s sent out %s!\n", player.Name, switchTo.Name)))
+		switchIn(player, foe, switchTo)
+	}
+}
+
+// firstHealthyBench returns the first Pokémon that is not active and can still fight, or nil if none is left
+func firstHealthyBench(player *Player) *Pokemon {
+	for _, pokemon := range player.Pokemons {
+		if !isActive(player, pokemon) && pokemon.Stats.HP > 0 {
+			return pokemon
+		}
+	}
+	return nil
+}
+
+// firstActiveSlot returns the first slot that still holds a Pokémon
+func firstActiveSlot(player *Player) (int, bool) {
+	for slot, pokemon := range player.Actives {
+		if pokemon != nil {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// isTimeout reports whether a read failed because the turn timer expired
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// isActive reports whether a Pokémon currently occupies one of the player's active slots
+func isActive(player *Player, pokemon *Pokemon) bool {
+	for _, active := range player.Actives {
+		if active == pokemon {
+			return true
+		}
+	}
+	return false
 }
 
 func allPokemonFainted(player *Player) bool {
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"github.com/eiannone/keyboard"
+	"github.com/mattn/go-runewidth"
+	"golang.org/x/term"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-const GridSize = 20
+// Size of the window onto the area; larger areas scroll to follow the player
+const (
+	ViewWidth  = 21
+	ViewHeight = 15
+)
 
 type Pokemon struct {
 	ID           string            `json:"id"`
@@ -20,18 +30,204 @@ type Pokemon struct {
 	Types        []string          `json:"types"`
 	Stats        map[string]string `json:"stats"`
 	Exp          string            `json:"exp"`
+	CatchRate    string            `json:"catch_rate"` // Pokédex entries only
 	WhenAttacked map[string]string `json:"when_attacked"`
 	X            int
 	Y            int
+	SpawnID      int `json:"spawn_id"`
+}
+
+// Trainer is another player's position on the shared map
+type Trainer struct {
+	Name string `json:"name"`
+	X    int    `json:"x"`
+	Y    int    `json:"y"`
+}
+
+// ClientMessage is an intent sent to the server; the server decides what actually happens
+type ClientMessage struct {
+	Type      string `json:"type"`
+	Direction string `json:"direction,omitempty"`
+	Ball      string `json:"ball,omitempty"`
+	Slot      int    `json:"slot,omitempty"`
+}
+
+// Ball is a ball the server lets the player throw during an encounter
+type Ball struct {
+	Key   string  `json:"key"`
+	Name  string  `json:"name"`
+	Bonus float64 `json:"bonus"`
+	Count int     `json:"count"` // How many the player has
+}
+
+// Encounter is the wild Pokémon the player is trying to catch
+type Encounter struct {
+	SpawnID   int      `json:"spawn_id"`
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Level     int      `json:"level"`
+	Types     []string `json:"types"`
+	Rarity    string   `json:"rarity"`
+	CatchRate int      `json:"catch_rate"`
+	Balls     []Ball   `json:"balls"`
+	Potions   int      `json:"potions"`
+	WildHP    int      `json:"wild_hp"`
+	WildMaxHP int      `json:"wild_max_hp"`
+	Team      []Member `json:"team"`
+	Active    int      `json:"active"`
+}
+
+// Member is one Pokémon of the player's battle team
+type Member struct {
+	Name  string `json:"name"`
+	HP    int    `json:"hp"`
+	MaxHP int    `json:"max_hp"`
+}
+
+// WalletView is the player's money and items
+type WalletView struct {
+	Money int       `json:"money"`
+	Bag   []BagItem `json:"bag"`
+}
+
+// BagItem is one kind of item the player owns
+type BagItem struct {
+	Key   string `json:"key"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"` // "ball", "potion" or "stone"
+	Count int    `json:"count"`
+}
+
+// DexEntry is what the player's Pokédex records about one species
+type DexEntry struct {
+	Caught      bool   `json:"caught"`
+	FirstSeen   string `json:"first_seen,omitempty"` // RFC 3339
+	FirstCaught string `json:"first_caught,omitempty"`
+}
+
+// ServerMessage is either the full world sent on joining ("state") or a change to it ("delta")
+type ServerMessage struct {
+	Type         string              `json:"type"`
+	X            int                 `json:"x"`        // State only
+	Y            int                 `json:"y"`        // State only
+	Title        string              `json:"title"`    // State only: name of the area
+	Width        int                 `json:"width"`    // State only
+	Height       int                 `json:"height"`   // State only
+	Terrain      []string            `json:"terrain"`  // State only: one row of tiles per string
+	Pokemons     []Pokemon           `json:"pokemons"` // Every wild Pokémon in a state, new spawns in a delta
+	Trainers     []Trainer           `json:"trainers"` // Everyone else in a state, joins and moves in a delta
+	Left         []string            `json:"left"`
+	Removed      []int               `json:"removed"`
+	Caught       int                 `json:"caught"`
+	Pokedex      map[string]DexEntry `json:"pokedex"`       // State only: species the player has encountered, by ID
+	Encounter    *Encounter          `json:"encounter"`     // Set when the player steps onto a wild Pokémon
+	EncounterEnd bool                `json:"encounter_end"` // The Pokémon was caught, fled, or the player ran
+	Wallet       *WalletView         `json:"wallet"`        // Always in a state, in a delta when it changed
+	Notification string              `json:"notification"`
+	Closed       bool                `json:"closed"` // The server ended the session, e.g. after a quit
+	Error        string              `json:"error"`
 }
 
-var lastNotification string
-var grid [GridSize][GridSize]rune
+var notifications []string // Most recent last; the sidebar shows the tail
+var grid [][]string // Glyphs of the visible map cells
+var areaTitle string
+var mapWidth, mapHeight int
 var playerX, playerY int
 var pokemons []Pokemon
-var mu sync.Mutex
+var terrain []string // Grass '.', water '~', cave ':', sand '_', walls '#' and warps 'O'
+var trainers = make(map[string]Trainer)
+var caughtCount int
+var closed bool
+var encounter *Encounter // The current encounter, nil while exploring
+var mu sync.Mutex // Guards the world view shared by the keyboard loop and the server reader
+var screen *Screen
+var theme Theme
+
+// Theme picks the glyphs drawn on the map
+type Theme struct {
+	Player  string
+	Wild    string
+	Trainer string
+	Trophy  string
+}
+
+// Themes players can choose between; ascii suits terminals and CI logs that can't show emoji
+var themes = map[string]Theme{
+	"emoji": {Player: "💂", Wild: "❓", Trainer: "👤", Trophy: "🏆"},
+	"ascii": {Player: "@", Wild: "?", Trainer: "&", Trophy: "*"},
+}
+
+// Every map cell is drawn this many terminal columns wide, so emoji and ASCII cells line up
+const cellWidth = 2
+
+// Keymap binds key names ("w", "?", "up", "esc", "ctrl+c", "space"...) to actions.
+// Exploring and encounters have separate bindings, so one key can move on the map and attack in a battle.
+type Keymap struct {
+	Preset    string            `json:"preset"`    // "arrows", "wasd" or "vi"; the arrow keys always move
+	Map       map[string]string `json:"map"`       // Added to or overriding the preset while exploring
+	Encounter map[string]string `json:"encounter"` // Added to or overriding the defaults during an encounter
+}
+
+// Movement presets for players without convenient arrow keys
+var presets = map[string]map[string]string{
+	"arrows": {},
+	"wasd":   {"w": "move_up", "a": "move_left", "s": "move_down", "d": "move_right"},
+	"vi":     {"k": "move_up", "h": "move_left", "j": "move_down", "l": "move_right"},
+}
+
+// Actions every keymap can bind, in the order the help overlay lists them
+var actions = []string{
+	"move_up", "move_down", "move_left", "move_right",
+	"attack", "switch", "potion", "ball_1", "ball_2", "ball_3", "flee",
+	"inventory", "caught", "pokedex", "help", "quit",
+}
+
+var keys struct {
+	Map       map[string]string
+	Encounter map[string]string
+}
+var overlay string       // "help", "inventory", "caught" or "pokedex" while one is open
+var caughtNames []string // Pokémon caught this session, for the caught list
+var wallet WalletView     // Money and items, for the sidebar and inventory
+
+// Pokédex browser state
+var dex []Pokemon // Every pokedex.json entry, in Pokédex order
+var pokedex = make(map[string]DexEntry) // The player's seen and caught species, by ID
+var dexCursor int     // Index into the filtered entries
+var dexType string    // Only list entries of this type; "" lists all
+var dexQuery string   // Only list entries whose name contains this
+var dexSearching bool // Typing goes into dexQuery
+var dexDetail bool    // Show the selected entry instead of the list
+
+// Layout of the game screen
+const (
+	sidebarWidth     = 34
+	maxNotifications = 8
+	resizeCheckEvery = 250 * time.Millisecond // How often to look for a resized terminal while idle
+)
 
 func main() {
+	themeName := flag.String("theme", os.Getenv("POKECAT_THEME"), "map glyphs: emoji or ascii (default from $POKECAT_THEME, else emoji)")
+	keysFile := flag.String("keys", "../keybindings.json", "key bindings file")
+	dexFile := flag.String("pokedex", "../pokedex.json", "Pokédex entries to browse")
+	flag.Parse()
+	if err := loadPokedex(*dexFile); err != nil {
+		fmt.Printf("Failed to load Pokédex: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadKeymap(*keysFile); err != nil {
+		fmt.Printf("Failed to load key bindings: %v\n", err)
+		os.Exit(1)
+	}
+	if *themeName == "" {
+		*themeName = "emoji"
+	}
+	var ok bool
+	if theme, ok = themes[*themeName]; !ok {
+		fmt.Printf("Unknown theme %q, choose emoji or ascii\n", *themeName)
+		os.Exit(1)
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
@@ -60,17 +256,12 @@ func main() {
 	conn.Write(authBytes)
 
 	// Receive authentication response
-	buffer := make([]byte, 2048)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		fmt.Printf("Failed to read authentication response: %v\n", err)
-		return
-	}
-
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
 	var authResponse map[string]interface{}
-	err = json.Unmarshal(buffer[:n], &authResponse)
+	err = decoder.Decode(&authResponse)
 	if err != nil {
-		fmt.Printf("Failed to parse authentication response: %v\n", err)
+		fmt.Printf("Failed to read authentication response: %v\n", err)
 		return
 	}
 
@@ -83,87 +274,497 @@ func main() {
 		return
 	}
 
-	// Initialize player position
-	playerX, playerY = GridSize/2, GridSize/2
-
-	// Receive Pokémon data from server
-	n, err = conn.Read(buffer)
-	if err != nil {
-		fmt.Printf("Failed to read Pokémon data: %v\n", err)
+	// Receive the starting world from the server
+	var state ServerMessage
+	if err := decoder.Decode(&state); err != nil {
+		fmt.Printf("Failed to read world state: %v\n", err)
 		return
 	}
-
-	fmt.Printf("Received data: %s\n", string(buffer[:n]))
-
-	err = json.Unmarshal(buffer[:n], &pokemons)
-	if err != nil {
-		fmt.Printf("Failed to parse Pokémon data: %v\n", err)
+	if state.Error != "" {
+		fmt.Println(state.Error, "Exiting.")
 		return
 	}
+	applyMessage(state, playerName)
 
-	initGrid()
-
-	err = keyboard.Open()
+	events, err := keyboard.GetKeys(10)
 	if err != nil {
 		fmt.Printf("Failed to initialize keyboard: %v\n", err)
 		return
 	}
 	defer keyboard.Close()
 
+	// Draw in place on the alternate screen; the normal screen comes back with the goodbye once the game ends
+	screen = newScreen(os.Stdout)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		screen.close()
+		if closed && caughtCount > 0 {
+			drawCongrats()
+		}
+		if len(notifications) > 0 {
+			fmt.Println(notifications[len(notifications)-1])
+		}
+	}()
+
+	// The server pushes changes at any time, including moves by other trainers
+	done := make(chan struct{})
+	go readServer(decoder, playerName, done)
+
+	mu.Lock()
+	render()
+	mu.Unlock()
+	resize := time.NewTicker(resizeCheckEvery)
+	defer resize.Stop()
 	for {
-		printGrid()
-		_, key, err := keyboard.GetKey()
-		if err != nil {
-			fmt.Printf("Error reading keyboard input: %v\n", err)
-			break
+		select {
+		case <-done:
+			return
+		case <-resize.C:
+			// Nothing is written unless the terminal size changed
+			mu.Lock()
+			render()
+			mu.Unlock()
+		case event := <-events:
+			if event.Err != nil {
+				mu.Lock()
+				notify(fmt.Sprintf("Error reading keyboard input: %v", event.Err))
+				mu.Unlock()
+				return
+			}
+
+			mu.Lock()
+			message, redraw := handleKey(keyName(event.Key, event.Rune))
+			if redraw {
+				render()
+			}
+			mu.Unlock()
+			if message.Type == "" {
+				continue
+			}
+
+			// Ask the server to act; the result arrives as a delta
+			if err := encoder.Encode(message); err != nil {
+				mu.Lock()
+				notify(fmt.Sprintf("Failed to send %s to server: %v", message.Type, err))
+				mu.Unlock()
+				return
+			}
+			if message.Type == "quit" {
+				// Wait for the server to confirm so the goodbye is shown, but don't hang on a dead server
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+				}
+				return
+			}
 		}
+	}
+}
 
-		if handleMovement(key) {
-			break
+// readServer applies every message from the server and redraws, closing done when the game ends
+func readServer(decoder *json.Decoder, playerName string, done chan<- struct{}) {
+	defer close(done)
+	for {
+		var message ServerMessage
+		if err := decoder.Decode(&message); err != nil {
+			mu.Lock()
+			notify(fmt.Sprintf("Lost connection to server: %v", err))
+			mu.Unlock()
+			return
+		}
+
+		mu.Lock()
+		applyMessage(message, playerName)
+		render()
+		finished := closed
+		mu.Unlock()
+		if finished {
+			return
 		}
+	}
+}
 
-		checkCapture(playerName)
+// applyMessage updates the local view of the world with a state or delta from the server
+func applyMessage(message ServerMessage, playerName string) {
+	switch message.Type {
+	case "state":
+		// A state is sent on joining and on entering another area, replacing the whole view
+		playerX, playerY = message.X, message.Y
+		areaTitle, mapWidth, mapHeight = message.Title, message.Width, message.Height
+		terrain = message.Terrain
+		pokemons = message.Pokemons
+		caughtCount = message.Caught
+		encounter = nil
+		if message.Pokedex != nil {
+			pokedex = message.Pokedex
+		}
+		trainers = make(map[string]Trainer)
+		for _, trainer := range message.Trainers {
+			trainers[trainer.Name] = trainer
+		}
+	case "delta":
+		for _, trainer := range message.Trainers {
+			if trainer.Name == playerName {
+				playerX, playerY = trainer.X, trainer.Y
+			} else {
+				trainers[trainer.Name] = trainer
+			}
+		}
+		for _, name := range message.Left {
+			delete(trainers, name)
+		}
+		for _, spawnID := range message.Removed {
+			for i, p := range pokemons {
+				if p.SpawnID == spawnID {
+					pokemons = append(pokemons[:i], pokemons[i+1:]...)
+					break
+				}
+			}
+		}
+		pokemons = append(pokemons, message.Pokemons...)
+		if message.Caught > caughtCount && encounter != nil {
+			caughtNames = append(caughtNames, encounter.Name)
+			if entry := pokedex[encounter.ID]; !entry.Caught {
+				entry.Caught, entry.FirstCaught = true, time.Now().UTC().Format(time.RFC3339)
+				pokedex[encounter.ID] = entry
+			}
+		}
+		if message.Caught > 0 {
+			caughtCount = message.Caught
+		}
+		if message.Encounter != nil {
+			encounter = message.Encounter
+			if _, seen := pokedex[encounter.ID]; !seen {
+				pokedex[encounter.ID] = DexEntry{FirstSeen: time.Now().UTC().Format(time.RFC3339)}
+			}
+		}
+		if message.EncounterEnd {
+			encounter = nil
+		}
+	}
+	if message.Wallet != nil {
+		wallet = *message.Wallet
 	}
+	closed = message.Closed
+	if message.Notification != "" {
+		notify(message.Notification)
+	}
+	initGrid()
 }
 
+// initGrid draws the part of the area around the player that fits in the viewport
 func initGrid() {
-	clearGrid()
-	drawTitle()
+	viewX, viewY := viewOrigin()
+	grid = make([][]string, min(ViewHeight, mapHeight))
+	for row := range grid {
+		grid[row] = make([]string, min(ViewWidth, mapWidth))
+		for col := range grid[row] {
+			grid[row][col] = string(terrain[viewY+row][viewX+col])
+		}
+	}
+
+	put := func(x, y int, cell string) {
+		if y >= viewY && y < viewY+len(grid) && x >= viewX && x < viewX+len(grid[y-viewY]) {
+			grid[y-viewY][x-viewX] = cell
+		}
+	}
 	for _, p := range pokemons {
-		if p.X < GridSize && p.Y < GridSize {
-			grid[p.Y][p.X] = '❓'
+		put(p.X, p.Y, theme.Wild)
+	}
+	for _, t := range trainers {
+		put(t.X, t.Y, theme.Trainer)
+	}
+	put(playerX, playerY, theme.Player)
+	if closed && caughtCount > 0 {
+		put(playerX, playerY, theme.Trophy)
+	}
+}
+
+// viewOrigin returns the map cell at the top left of the viewport, keeping the player centered where the area allows
+func viewOrigin() (int, int) {
+	clamp := func(center, view, size int) int {
+		return max(0, min(center-view/2, size-view))
+	}
+	return clamp(playerX, ViewWidth, mapWidth), clamp(playerY, ViewHeight, mapHeight)
+}
+
+// notify adds a message to the sidebar history, one entry per line
+func notify(message string) {
+	notifications = append(notifications, strings.Split(message, "\n")...)
+	if len(notifications) > maxNotifications {
+		notifications = notifications[len(notifications)-maxNotifications:]
+	}
+}
+
+// render lays out the map, the sidebar and the action panel, then writes only what changed
+func render() {
+	screen.begin()
+	if overlay == "pokedex" {
+		for i, line := range dexLines(screen.height) {
+			screen.text(0, i, line)
+		}
+		screen.flush()
+		return
+	}
+	mapColumns := 0
+	for row, cells := range grid {
+		for col, cell := range cells {
+			screen.text(col*cellWidth, row, pad(cell, cellWidth))
+		}
+		mapColumns = len(cells) * cellWidth
+	}
+
+	// The sidebar sits right of the map, or below everything on narrow terminals
+	panel := actionPanel()
+	sidebarX, sidebarY := mapColumns+2, 0
+	if screen.width < sidebarX+sidebarWidth {
+		sidebarX, sidebarY = 0, len(grid)+len(panel)+2
+	}
+	for i, line := range sidebar() {
+		screen.text(sidebarX, sidebarY+i, line)
+	}
+	for i, line := range panel {
+		screen.text(0, len(grid)+1+i, line)
+	}
+	screen.flush()
+}
+
+// sidebar describes where the player is, what they've caught, what's nearby and what just happened
+func sidebar() []string {
+	lines := []string{
+		areaTitle,
+		fmt.Sprintf("Position (%d, %d)", playerX, playerY),
+		fmt.Sprintf("Caught this session: %d", caughtCount),
+		fmt.Sprintf("Money: ₽%d", wallet.Money),
+		fmt.Sprintf("Other trainers here: %d", len(trainers)),
+		"",
+		"Nearby Pokémon:",
+	}
+
+	nearby := append([]Pokemon(nil), pokemons...)
+	sort.Slice(nearby, func(i, j int) bool {
+		return distance(nearby[i]) < distance(nearby[j])
+	})
+	if len(nearby) == 0 {
+		lines = append(lines, "  none in this area")
+	}
+	for _, p := range nearby[:min(len(nearby), 5)] {
+		lines = append(lines, fmt.Sprintf("  %s %s", p.Name, direction(p.X-playerX, p.Y-playerY)))
+	}
+
+	lines = append(lines, "", "Messages:")
+	for _, note := range notifications {
+		lines = append(lines, wrap(note, sidebarWidth-2)...)
+	}
+	return lines
+}
+
+// wrap breaks text into indented lines of at most width characters, at spaces where possible
+func wrap(text string, width int) []string {
+	var lines []string
+	runes := []rune(text)
+	for len(runes) > width {
+		cut := width
+		for i := width; i > 0; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		lines = append(lines, "  "+string(runes[:cut]))
+		runes = []rune(strings.TrimSpace(string(runes[cut:])))
+	}
+	return append(lines, "  "+string(runes))
+}
+
+// distance is how many steps a wild Pokémon is from the player
+func distance(p Pokemon) int {
+	return abs(p.X-playerX) + abs(p.Y-playerY)
+}
+
+// direction describes an offset from the player in steps, e.g. "3E 2N"
+func direction(dx, dy int) string {
+	var parts []string
+	if dx > 0 {
+		parts = append(parts, fmt.Sprintf("%dE", dx))
+	} else if dx < 0 {
+		parts = append(parts, fmt.Sprintf("%dW", -dx))
+	}
+	if dy > 0 {
+		parts = append(parts, fmt.Sprintf("%dS", dy))
+	} else if dy < 0 {
+		parts = append(parts, fmt.Sprintf("%dN", -dy))
+	}
+	if len(parts) == 0 {
+		return "(here)"
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// actionPanel lists the legend and what the player can do right now
+func actionPanel() []string {
+	switch {
+	case overlay != "":
+		return append(overlayLines(), "", "Press any key to close")
+	case encounter != nil:
+		return encounterLines()
+	}
+	return []string{
+		"Terrain: . grass  ~ water  : cave  _ sand  # wall  O warp",
+		fmt.Sprintf("%s move, %s for help, %s quits", keysFor(keys.Map, "move_up", "move_left", "move_down", "move_right"),
+			keysFor(keys.Map, "help"), keysFor(keys.Map, "quit")),
+	}
+}
+
+// overlayLines is the content of the open overlay
+func overlayLines() []string {
+	switch overlay {
+	case "inventory":
+		lines := []string{fmt.Sprintf("Bag (₽%d):", wallet.Money)}
+		if len(wallet.Bag) == 0 {
+			return append(lines, "  empty. Buy balls and potions at the hub's shop.")
+		}
+		for _, item := range wallet.Bag {
+			lines = append(lines, fmt.Sprintf("  %-14s x%d", item.Name, item.Count))
+		}
+		return lines
+	case "caught":
+		if len(caughtNames) == 0 {
+			return []string{"Caught this session:", "  nothing yet"}
 		}
+		return append([]string{"Caught this session:"}, wrap(strings.Join(caughtNames, ", "), 60)...)
 	}
-	grid[playerY][playerX] = '💂'
+
+	lines := []string{"Keys (exploring | encounter):"}
+	for _, action := range actions {
+		lines = append(lines, fmt.Sprintf("  %-11s %-16s | %s", action, keysFor(keys.Map, action), keysFor(keys.Encounter, action)))
+	}
+	return lines
 }
 
-func clearGrid() {
-	for i := 0; i < GridSize; i++ {
-		for j := 0; j < GridSize; j++ {
-			grid[i][j] = '.'
+// keysFor lists the keys bound to any of the given actions
+func keysFor(bindings map[string]string, wanted ...string) string {
+	var names []string
+	for key, action := range bindings {
+		for _, w := range wanted {
+			if action == w {
+				names = append(names, key)
+			}
 		}
 	}
+	if len(names) == 0 {
+		return "-"
+	}
+	sort.Strings(names)
+	return strings.Join(names, "/")
 }
 
-func printGrid() {
-	clearScreen()
-	drawTitle()
-	for _, row := range grid {
-		for _, cell := range row {
-			fmt.Printf("%c ", cell)
+// pad fills a glyph with spaces up to the given number of terminal columns
+func pad(glyph string, width int) string {
+	return glyph + strings.Repeat(" ", max(width-runewidth.StringWidth(glyph), 0))
+}
+
+// Screen is a double-buffered terminal: each frame is drawn into back, then only the cells
+// that differ from front, which mirrors what the terminal shows, are written out
+type Screen struct {
+	width, height int
+	front, back   [][]string // One string per terminal column; "" marks the right half of a wide character
+	out           *bufio.Writer
+	fd            int
+}
+
+// newScreen switches the terminal to its alternate screen and hides the cursor
+func newScreen(out *os.File) *Screen {
+	s := &Screen{out: bufio.NewWriter(out), fd: int(out.Fd())}
+	io.WriteString(s.out, "\x1b[?1049h\x1b[?25l")
+	return s
+}
+
+// begin starts a frame, picking up any change in terminal size
+func (s *Screen) begin() {
+	width, height, err := term.GetSize(s.fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+	if width != s.width || height != s.height {
+		// Everything moves on a resize, so forget what the terminal shows and redraw it all
+		s.width, s.height = width, height
+		s.front = s.cells("")
+		io.WriteString(s.out, "\x1b[2J")
+	}
+	s.back = s.cells(" ")
+}
+
+// cells allocates a buffer the size of the terminal filled with one value
+func (s *Screen) cells(fill string) [][]string {
+	buffer := make([][]string, s.height)
+	for y := range buffer {
+		buffer[y] = make([]string, s.width)
+		for x := range buffer[y] {
+			buffer[y][x] = fill
 		}
-		fmt.Println()
 	}
+	return buffer
+}
 
-	if lastNotification != "" {
-		fmt.Println("\n" + lastNotification)
-		lastNotification = ""
+// text draws a string into the back buffer by display width, clipped to the terminal
+func (s *Screen) text(x, y int, str string) {
+	if y < 0 || y >= s.height {
+		return
 	}
-	if len(pokemons) == 0 {
-		drawCongrats()
+	for _, r := range str {
+		width := runewidth.RuneWidth(r)
+		if width == 0 {
+			continue // Combining marks and variation selectors would desync the columns
+		}
+		if x+width > s.width {
+			return
+		}
+		if x >= 0 {
+			s.back[y][x] = string(r)
+			if width == 2 {
+				s.back[y][x+1] = ""
+			}
+		}
+		x += width
 	}
 }
 
+// flush writes the runs of cells that changed since the last frame
+func (s *Screen) flush() {
+	for y := range s.back {
+		for x := 0; x < s.width; x++ {
+			if s.back[y][x] == s.front[y][x] {
+				continue
+			}
+			// Never start writing in the middle of a wide character
+			if s.back[y][x] == "" && x > 0 {
+				x--
+			}
+			fmt.Fprintf(s.out, "\x1b[%d;%dH", y+1, x+1)
+			for ; x < s.width && (s.back[y][x] != s.front[y][x] || s.back[y][x] == ""); x++ {
+				io.WriteString(s.out, s.back[y][x])
+				s.front[y][x] = s.back[y][x]
+			}
+		}
+	}
+	s.out.Flush()
+}
+
+// close gives the terminal back its normal screen and cursor
+func (s *Screen) close() {
+	io.WriteString(s.out, "\x1b[?25h\x1b[?1049l")
+	s.out.Flush()
+}
+
 func drawCongrats() {
 	fmt.Println("░█████╗░░█████╗░███╗░░██╗░██████╗░██████╗░░█████╗░████████╗░██████╗")
 	fmt.Println("██╔══██╗██╔══██╗████╗░██║██╔════╝░██╔══██╗██╔══██╗╚══██╔══╝██╔════╝")
@@ -171,7 +772,7 @@ func drawCongrats() {
 	fmt.Println("██║░░██╗██║░░██║██║╚████║██║░░╚██╗██╔══██╗██╔══██║░░░██║░░░░╚═══██╗")
 	fmt.Println("╚█████╔╝╚█████╔╝██║░╚███║╚██████╔╝██║░░██║██║░░██║░░░██║░░░██████╔╝")
 	fmt.Println("░╚════╝░░╚════╝░╚═╝░░╚══╝░╚═════╝░╚═╝░░╚═╝╚═╝░░╚═╝░░░╚═╝░░░╚═════╝░")
-	fmt.Println("\n Congratulations! You've caught all the Pokémon!")
+	fmt.Printf("\n Congratulations! You caught %d Pokémon this session!\n", caughtCount)
 	fmt.Println(" Exiting the game. Goodbye!")
 	fmt.Println("=========================================================================\n")
 }
@@ -191,158 +792,391 @@ func drawTitle() {
 	fmt.Println("                                `'                            '-._|")
 }
 
-func handleMovement(key keyboard.Key) bool {
-	grid[playerY][playerX] = '.'
-
-	switch key {
-	case keyboard.KeyArrowUp:
-		if playerY > 0 {
-			playerY--
+// encounterLines describe the battle against the wild Pokémon and what the player can do
+func encounterLines() []string {
+	lines := []string{
+		fmt.Sprintf("Wild %s Lv. %d (ID: %s) - Types: %v - Rarity: %s - Catch rate: %d", encounter.Name, encounter.Level, encounter.ID, encounter.Types, encounter.Rarity, encounter.CatchRate),
+		fmt.Sprintf("  HP %d/%d", encounter.WildHP, encounter.WildMaxHP),
+	}
+	if len(encounter.Team) > 0 {
+		lines = append(lines, "Your team:")
+		for i, member := range encounter.Team {
+			marker := " "
+			if i == encounter.Active {
+				marker = ">"
+			}
+			lines = append(lines, fmt.Sprintf(" %s %s HP %d/%d", marker, member.Name, member.HP, member.MaxHP))
 		}
-	case keyboard.KeyArrowDown:
-		if playerY < GridSize-1 {
-			playerY++
+		lines = append(lines,
+			fmt.Sprintf("  %s. Attack (weaken it to make it easier to catch)", keysFor(keys.Encounter, "attack")),
+			fmt.Sprintf("  %s. Switch to your next Pokémon", keysFor(keys.Encounter, "switch")),
+			fmt.Sprintf("  %s. Use a potion (%d left)", keysFor(keys.Encounter, "potion"), encounter.Potions))
+	}
+	for i, ball := range encounter.Balls {
+		lines = append(lines, fmt.Sprintf("  %s. Throw a %s (x%.1f, %d left)", keysFor(keys.Encounter, fmt.Sprintf("ball_%d", i+1)), ball.Name, ball.Bonus, ball.Count))
+	}
+	return append(lines, fmt.Sprintf("  %s. Flee", keysFor(keys.Encounter, "flee")))
+}
+
+// loadKeymap builds the exploring and encounter bindings from the defaults, the chosen preset and the
+// overrides in the key bindings file. A missing file leaves the defaults with the arrows preset.
+func loadKeymap(filename string) error {
+	keymap := Keymap{Preset: "arrows"}
+	file, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read key bindings: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(file, &keymap); err != nil {
+			return fmt.Errorf("failed to parse key bindings: %v", err)
 		}
-	case keyboard.KeyArrowLeft:
-		if playerX > 0 {
-			playerX--
+	}
+	preset, ok := presets[keymap.Preset]
+	if !ok {
+		return fmt.Errorf("unknown preset %q, choose arrows, wasd or vi", keymap.Preset)
+	}
+
+	common := map[string]string{"esc": "quit", "ctrl+c": "quit", "?": "help", "i": "inventory", "c": "caught", "p": "pokedex"}
+	keys.Map = map[string]string{"up": "move_up", "down": "move_down", "left": "move_left", "right": "move_right"}
+	keys.Encounter = map[string]string{"a": "attack", "s": "switch", "h": "potion", "1": "ball_1", "2": "ball_2", "3": "ball_3", "f": "flee"}
+	for _, layer := range []map[string]string{common, preset, keymap.Map} {
+		for key, action := range layer {
+			keys.Map[strings.ToLower(key)] = action
 		}
-	case keyboard.KeyArrowRight:
-		if playerX < GridSize-1 {
-			playerX++
+	}
+	for _, layer := range []map[string]string{common, keymap.Encounter} {
+		for key, action := range layer {
+			keys.Encounter[strings.ToLower(key)] = action
 		}
-	case keyboard.KeyEsc:
-		return true
 	}
 
-	grid[playerY][playerX] = '💂'
-	return false
+	// Catch typos early rather than leaving a key that silently does nothing
+	for _, bindings := range []map[string]string{keys.Map, keys.Encounter} {
+		for key, action := range bindings {
+			known := false
+			for _, a := range actions {
+				known = known || a == action
+			}
+			if !known {
+				return fmt.Errorf("key %q is bound to unknown action %q", key, action)
+			}
+		}
+	}
+	return nil
 }
 
-func clearScreen() {
-	cmd := exec.Command("clear")
-	if os.Getenv("OS") == "Windows_NT" {
-		cmd = exec.Command("cmd", "/c", "cls")
+// keyName turns a key press into the name used in key bindings
+func keyName(key keyboard.Key, char rune) string {
+	switch key {
+	case keyboard.KeyArrowUp:
+		return "up"
+	case keyboard.KeyArrowDown:
+		return "down"
+	case keyboard.KeyArrowLeft:
+		return "left"
+	case keyboard.KeyArrowRight:
+		return "right"
+	case keyboard.KeyEsc:
+		return "esc"
+	case keyboard.KeyCtrlC:
+		return "ctrl+c"
+	case keyboard.KeyEnter:
+		return "enter"
+	case keyboard.KeySpace:
+		return "space"
+	case keyboard.KeyTab:
+		return "tab"
+	case keyboard.KeyBackspace, keyboard.KeyBackspace2:
+		return "backspace"
 	}
-	cmd.Stdout = os.Stdout
-	cmd.Run()
+	return strings.ToLower(string(char))
 }
 
-var caughtPokemons []Pokemon
+// handleKey runs the action bound to a key. Overlays are handled locally and ask for a redraw;
+// everything else becomes an intent for the server.
+func handleKey(name string) (ClientMessage, bool) {
+	if overlay == "pokedex" {
+		return ClientMessage{}, handleDexKey(name)
+	}
+	// Any key closes an open overlay
+	if overlay != "" {
+		overlay = ""
+		return ClientMessage{}, true
+	}
 
-func savePlayerData(playerName string, pokemons []Pokemon) {
-	mu.Lock()
-	defer mu.Unlock()
+	bindings := keys.Map
+	if encounter != nil {
+		bindings = keys.Encounter
+	}
+	switch action := bindings[name]; action {
+	case "move_up", "move_down", "move_left", "move_right":
+		if encounter == nil {
+			return ClientMessage{Type: "move", Direction: strings.TrimPrefix(action, "move_")}, false
+		}
+	case "attack", "flee":
+		if encounter != nil {
+			return ClientMessage{Type: action}, false
+		}
+	case "switch":
+		if encounter == nil {
+			break
+		}
+		// Cycle to the next team member that can still fight
+		for i := 1; i < len(encounter.Team); i++ {
+			slot := (encounter.Active + i) % len(encounter.Team)
+			if encounter.Team[slot].HP > 0 {
+				return ClientMessage{Type: "switch", Slot: slot}, false
+			}
+		}
+	case "potion":
+		if encounter != nil {
+			return ClientMessage{Type: "heal"}, false
+		}
+	case "ball_1", "ball_2", "ball_3":
+		index := int(action[len(action)-1] - '1')
+		if encounter != nil && index < len(encounter.Balls) {
+			return ClientMessage{Type: "throw", Ball: encounter.Balls[index].Key}, false
+		}
+	case "inventory", "caught", "pokedex", "help":
+		overlay = action
+		return ClientMessage{}, true
+	case "quit":
+		return ClientMessage{Type: "quit"}, false
+	}
+	return ClientMessage{}, false
+}
 
-	// Open the player data file
-	file, err := os.OpenFile("./player_data.json", os.O_RDWR|os.O_CREATE, 0644)
+// loadPokedex reads the entries the Pokédex browser lists
+func loadPokedex(filename string) error {
+	file, err := os.ReadFile(filename)
 	if err != nil {
-		fmt.Printf("Failed to open player data file: %v\n", err)
-		return
+		return fmt.Errorf("failed to read Pokédex: %v", err)
+	}
+	if err := json.Unmarshal(file, &dex); err != nil {
+		return fmt.Errorf("failed to parse Pokédex: %v", err)
 	}
-	defer file.Close()
+	return nil
+}
 
-	var allPlayers []map[string]interface{}
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&allPlayers)
-	if err != nil && err.Error() != "EOF" {
-		fmt.Printf("Failed to read player data: %v\n", err)
-		return
+// dexEntries lists the Pokédex entries matching the type filter and search
+func dexEntries() []Pokemon {
+	var entries []Pokemon
+	query := strings.ToLower(dexQuery)
+	for _, p := range dex {
+		if dexType != "" && !containsString(p.Types, dexType) {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(p.Name), query) {
+			continue
+		}
+		entries = append(entries, p)
 	}
+	return entries
+}
 
-	// Prepare the Pokémon data to be added
-	var cleanedPokemons []map[string]interface{}
-	for _, p := range pokemons {
-		cleanedPokemon := map[string]interface{}{
-			"id":            p.ID,
-			"name":          p.Name,
-			"types":         p.Types,
-			"stats":         p.Stats,
-			"exp":           p.Exp,
-			"when_attacked": p.WhenAttacked,
-		}
-		cleanedPokemons = append(cleanedPokemons, cleanedPokemon)
-	}
-
-	playerFound := false
-	for i, player := range allPlayers {
-		if player["player_name"] == playerName {
-			// Check if player already has the Pokémon
-			if existingPokemons, ok := player["pokemons"].([]interface{}); ok {
-				existingIDs := make(map[string]bool)
-				for _, ep := range existingPokemons {
-					if epMap, ok := ep.(map[string]interface{}); ok {
-						if id, ok := epMap["id"].(string); ok {
-							existingIDs[id] = true
-						}
-					}
-				}
+// dexTypes lists every type in the Pokédex, for cycling the filter
+func dexTypes() []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, p := range dex {
+		for _, t := range p.Types {
+			if !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
+		}
+	}
+	sort.Strings(types)
+	return types
+}
 
-				// Add only new Pokémon
-				for _, newPokemon := range cleanedPokemons {
-					if id, ok := newPokemon["id"].(string); ok {
-						if !existingIDs[id] {
-							existingPokemons = append(existingPokemons, newPokemon)
-						}
-					}
-				}
+func containsString(list []string, want string) bool {
+	for _, s := range list {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
 
-				// Update the player's Pokémon list
-				allPlayers[i]["pokemons"] = existingPokemons
-			} else {
-				// If "pokemons" is not correctly structured, replace it
-				allPlayers[i]["pokemons"] = cleanedPokemons
+// handleDexKey drives the Pokédex browser and reports whether the screen needs redrawing
+func handleDexKey(name string) bool {
+	if dexSearching {
+		switch name {
+		case "enter", "esc":
+			dexSearching = false
+		case "backspace":
+			if query := []rune(dexQuery); len(query) > 0 {
+				dexQuery = string(query[:len(query)-1])
 			}
-			playerFound = true
-			break
+		case "space":
+			dexQuery += " "
+		default:
+			if len([]rune(name)) != 1 {
+				return false
+			}
+			dexQuery += name
 		}
+		dexCursor = 0
+		return true
+	}
+	if dexDetail {
+		// Any key goes back to the list
+		dexDetail = false
+		return true
 	}
 
-	if !playerFound {
-		// Add a new player if not found
-		playerData := map[string]interface{}{
-			"player_name": playerName,
-			"pokemons":    cleanedPokemons,
+	entries := dexEntries()
+	switch action := keys.Map[name]; {
+	case name == "enter" || name == "space":
+		dexDetail = len(entries) > 0
+	case action == "move_up":
+		dexCursor--
+	case action == "move_down":
+		dexCursor++
+	case action == "move_left":
+		dexCursor -= 10
+	case action == "move_right":
+		dexCursor += 10
+	case name == "/":
+		dexSearching = true
+	case name == "t":
+		// Cycle through the types, then back to listing everything
+		types := append(dexTypes(), "")
+		for i, t := range types {
+			if t == dexType {
+				dexType = types[(i+1)%len(types)]
+				break
+			}
 		}
-		allPlayers = append(allPlayers, playerData)
+		dexCursor = 0
+	case name == "esc" || action == "pokedex" || action == "quit":
+		overlay = ""
+	default:
+		return false
 	}
+	dexCursor = max(0, min(dexCursor, len(entries)-1))
+	return true
+}
 
-	// Write updated data back to the file
-	file.Seek(0, 0)
-	file.Truncate(0) // Clear existing content
+// dexLines draws the Pokédex browser to fit a screen of the given height
+func dexLines(height int) []string {
+	seen, owned := 0, 0
+	for _, p := range dex {
+		if entry, ok := pokedex[p.ID]; ok {
+			seen++
+			if entry.Caught {
+				owned++
+			}
+		}
+	}
+	filter := dexType
+	if filter == "" {
+		filter = "all"
+	}
+	search := dexQuery
+	if dexSearching {
+		search += "_"
+	}
+	lines := []string{
+		fmt.Sprintf("Pokédex: %d seen (%s), %d caught (%s) of %d", seen, percent(seen, len(dex)), owned, percent(owned, len(dex)), len(dex)),
+		fmt.Sprintf("Type: %s   Search: %s", filter, search),
+		"",
+	}
 
-	data, err := json.MarshalIndent(allPlayers, "", "  ")
-	if err != nil {
-		fmt.Printf("Failed to marshal player data: %v\n", err)
-		return
+	entries := dexEntries()
+	if dexDetail && dexCursor < len(entries) {
+		return append(append(lines, dexDetailLines(entries[dexCursor])...), "", "Press any key to go back")
+	}
+	if len(entries) == 0 {
+		lines = append(lines, "  No Pokémon match.")
 	}
 
-	_, err = file.Write(data)
-	if err != nil {
-		fmt.Printf("Failed to write player data to file: %v\n", err)
+	// Keep the cursor inside a window that fits between the header and the footer
+	rows := max(1, height-len(lines)-2)
+	first := max(0, min(dexCursor-rows/2, len(entries)-rows))
+	for i := first; i < len(entries) && i < first+rows; i++ {
+		p := entries[i]
+		marker := " "
+		if i == dexCursor {
+			marker = ">"
+		}
+		lines = append(lines, fmt.Sprintf("%s #%03s %-12s %-16s %s", marker, p.ID, p.Name, strings.Join(p.Types, "/"), dexStatus(p.ID)))
 	}
+	return append(lines, "", fmt.Sprintf("%s select, Enter details, t type, / search, %s closes",
+		keysFor(keys.Map, "move_up", "move_down"), keysFor(keys.Map, "pokedex")))
 }
 
+// dexStatus marks whether the player has caught or seen a species
+func dexStatus(id string) string {
+	switch {
+	case pokedex[id].Caught:
+		return "caught"
+	case pokedex[id] != DexEntry{}:
+		return "seen"
+	}
+	return ""
+}
 
+// percent formats part of a total as a percentage with one decimal
+func percent(part, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(part)/float64(total))
+}
 
+// dexDate shortens an RFC 3339 timestamp to its date
+func dexDate(stamp string) string {
+	if t, err := time.Parse(time.RFC3339, stamp); err == nil {
+		return t.Local().Format("2006-01-02")
+	}
+	return "(date unknown)"
+}
 
-func checkCapture(playerName string) {
-	for i, p := range pokemons {
-		if p.X == playerX && p.Y == playerY {
-			lastNotification = fmt.Sprintf("You caught a Pokémon: %s (ID: %s)!", p.Name, p.ID)
-			caughtPokemons = append(caughtPokemons, p)
-			pokemons = append(pokemons[:i], pokemons[i+1:]...)
-			grid[p.Y][p.X] = '👍'
-
-			if len(pokemons) == 0 {
-				savePlayerData(playerName, caughtPokemons)
-				grid[playerY][playerX] = '🏆'
-				printGrid()
-				keyboard.Close()
+// dexDetailLines describes one Pokédex entry: types, stats and how it takes each attack type
+func dexDetailLines(p Pokemon) []string {
+	lines := []string{
+		fmt.Sprintf("#%03s %s  %s", p.ID, p.Name, dexStatus(p.ID)),
+		fmt.Sprintf("  Types: %s", strings.Join(p.Types, "/")),
+		fmt.Sprintf("  Catch rate: %s  Base exp: %s", p.CatchRate, p.Exp),
+	}
+	if entry, seen := pokedex[p.ID]; seen {
+		lines = append(lines, fmt.Sprintf("  First seen: %s", dexDate(entry.FirstSeen)))
+		if entry.Caught {
+			lines = append(lines, fmt.Sprintf("  First caught: %s", dexDate(entry.FirstCaught)))
+		}
+	}
+	lines = append(lines, "", "Stats:")
+	for _, stat := range []string{"HP", "Attack", "Defense", "Sp Atk", "Sp Def", "Speed"} {
+		lines = append(lines, fmt.Sprintf("  %-8s %s", stat, p.Stats[stat]))
+	}
 
-				os.Exit(0)
+	// Group attack types by how much damage they do, most effective first
+	groups := []struct{ title, multipliers string }{
+		{"Weak to", "4x 2x"},
+		{"Resists", "0.5x 0.25x"},
+		{"Immune to", "0x"},
+	}
+	lines = append(lines, "", "When attacked:")
+	for _, group := range groups {
+		var matches []string
+		for _, multiplier := range strings.Fields(group.multipliers) {
+			var types []string
+			for attack, m := range p.WhenAttacked {
+				if m == multiplier {
+					types = append(types, attack)
+				}
 			}
-			return
+			sort.Strings(types)
+			for _, t := range types {
+				matches = append(matches, fmt.Sprintf("%s %s", t, multiplier))
+			}
+		}
+		if len(matches) > 0 {
+			lines = append(lines, fmt.Sprintf("  %s:", group.title))
+			lines = append(lines, wrap(strings.Join(matches, ", "), 60)...)
 		}
 	}
+	return lines
 }
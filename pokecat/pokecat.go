@@ -2,23 +2,76 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
+
+	"projec/store"
 )
 
-// Configuration constants
+// Terrain tiles of the Pokecat map
 const (
-	GridSize         = 20 // Grid size of the world
-	PokemonsPerPlayer = 3 // Number of Pokémon assigned per player
+	TileGrass = '.'
+	TileWater = '~' // Needs a water-type Pokémon to surf across
+	TileCave  = ':'
+	TileSand  = '_'
+	TileWall  = '#' // Blocks movement and spawns
+	TileWarp  = 'O' // Leads to another area; no spawns
 )
 
+// WorldMap is the layout loaded from the map file: named areas joined by warp tiles
+type WorldMap struct {
+	Start struct {
+		Area string `json:"area"`
+		X    int    `json:"x"`
+		Y    int    `json:"y"`
+	} `json:"start"` // Where trainers join and return to after losing a battle
+	Areas []*Area `json:"areas"`
+}
+
+// Area is one named region of the map with its own dimensions
+type Area struct {
+	Name   string   `json:"name"`
+	Title  string   `json:"title"`
+	Tiles  []string `json:"tiles"` // One row of tiles per string, all the same length
+	Warps  []Warp   `json:"warps"`
+	Levels []int    `json:"levels"` // Lowest and highest level of wild Pokémon here; DefaultLevel when unset
+	Width  int      `json:"-"`
+	Height int      `json:"-"`
+}
+
+// Warp moves a trainer who steps on it to a position in another area
+type Warp struct {
+	X   int    `json:"x"`
+	Y   int    `json:"y"`
+	To  string `json:"to"`
+	ToX int    `json:"to_x"`
+	ToY int    `json:"to_y"`
+}
+
+// terrainTypes lists the Pokémon types that are more likely to spawn on each tile
+var terrainTypes = map[rune][]string{
+	TileGrass: {"grass", "bug", "normal", "poison", "flying", "fairy"},
+	TileWater: {"water", "ice"},
+	TileCave:  {"rock", "ground", "ghost", "dark", "steel"},
+	TileSand:  {"ground", "fire", "fighting", "electric"},
+}
+
+// How many times more likely a species is to spawn on terrain that suits one of its types
+const terrainBonus = 5
+
 // Pokemon represents the structure of a Pokémon
 type Pokemon struct {
 	ID          string            `json:"id"`
@@ -26,26 +79,339 @@ type Pokemon struct {
 	Types       []string          `json:"types"`
 	Stats       map[string]string `json:"stats"`
 	Exp         string            `json:"exp"`
+	Level       int               `json:"level,omitempty"`
+	CatchRate   string            `json:"catch_rate"`
+	InstanceID  string            `json:"instance_id,omitempty"` // Identifies one caught Pokémon; empty for wild ones
+	IVs         map[string]int    `json:"ivs,omitempty"`         // Individual values rolled at catch time, 0 to maxIV per stat
+	Nature      string            `json:"nature,omitempty"`      // Key into natures.json, rolled at catch time
+	Evolutions  []Evolution       `json:"evolutions,omitempty"`  // Pokédex entries only
 	WhenAttacked map[string]string `json:"when_attacked"`
 	X           int               // X coordinate on the grid
 	Y           int               // Y coordinate on the grid
+	Area        string            // Name of the area the spawn is in
+	SpawnID     int               // Identifies this spawn on the shared map
+	EngagedBy   string            // Player currently trying to catch this spawn
+	Rarity      string            // Name of the spawn's rarity tier
+	ExpiresAt   time.Time         // When the spawn leaves the map if nobody is catching it; zero for never
+}
+
+// Evolution is one way a species evolves into another, as listed in pokedex.json
+type Evolution struct {
+	To      string `json:"to"`              // Pokédex ID of the evolved species
+	Trigger string `json:"trigger"`         // "level", "item" or "trade"
+	Level   int    `json:"level,omitempty"` // Level trigger: the level it evolves at
+	Item    string `json:"item,omitempty"`  // Item trigger: the item used; trade trigger: the item held, if any
+}
+
+// Highest level a Pokémon can grow to
+const maxLevel = 100
+
+// Nature raises one battle stat and lowers another, as described in natures.json
+type Nature struct {
+	Name      string `json:"name"`
+	Increased string `json:"increased"` // Empty for neutral natures
+	Decreased string `json:"decreased"`
+}
+
+// Individual values run from 0 to maxIV; at the level the Pokédex stats describe, each point adds half a stat point
+const maxIV = 31
+
+// Natures scale the stats they raise and lower by these factors
+const (
+	natureBoost = 1.1
+	natureDrop  = 0.9
+)
+
+// statNames lists the battle stats in the order individual values are rolled
+var statNames = []string{"HP", "Attack", "Defense", "Sp Atk", "Sp Def", "Speed"}
+
+// SpawnConfig controls how wild Pokémon appear on and leave the shared map
+type SpawnConfig struct {
+	IntervalSeconds  int          `json:"interval_seconds"`    // Time between spawn waves
+	BatchSize        int          `json:"batch_size"`          // Pokémon placed per wave
+	MaxWildPerPlayer int          `json:"max_wild_per_player"` // Waves stop once the map holds this many per connected player
+	LifetimeSeconds  int          `json:"lifetime_seconds"`    // How long a spawn stays before leaving; 0 keeps it until caught
+	RarityBy         string       `json:"rarity_by"`           // "base_stat_total" or "exp"
+	Tiers            []RarityTier `json:"tiers"`               // Ordered from most common to rarest
+}
+
+// RarityTier groups the species whose rarity score is at most Max; Weight is the tier's share of spawns
+type RarityTier struct {
+	Name    string `json:"name"`
+	Max     int    `json:"max"` // 0 means no upper bound
+	Weight  int    `json:"weight"`
+	species []int  // Indexes into pokemons
+}
+
+// Ball is a kind of ball that can be thrown during an encounter
+type Ball struct {
+	Key   string  `json:"key"`
+	Name  string  `json:"name"`
+	Bonus float64 `json:"bonus"` // Multiplies the species catch rate
+	Count int     `json:"count"` // How many the player has, when sent to a client
+}
+
+// Balls a player can throw, in the order the client lists them
+var balls = []Ball{
+	{Key: "poke_ball", Name: "Poké Ball", Bonus: 1},
+	{Key: "great_ball", Name: "Great Ball", Bonus: 1.5},
+	{Key: "ultra_ball", Name: "Ultra Ball", Bonus: 2},
+}
+
+// Encounter describes the wild Pokémon a player is trying to catch
+type Encounter struct {
+	SpawnID   int      `json:"spawn_id"`
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Level     int      `json:"level"`
+	Types     []string `json:"types"`
+	Rarity    string   `json:"rarity"`
+	CatchRate int      `json:"catch_rate"`
+	Balls     []Ball   `json:"balls"`
+	Potions   int      `json:"potions"` // Potions of every kind the player has
+	WildHP    int      `json:"wild_hp"`
+	WildMaxHP int      `json:"wild_max_hp"`
+	Team      []Member `json:"team"`   // The player's battle team; empty if they have no Pokémon yet
+	Active    int      `json:"active"` // Index into Team of the Pokémon fighting
+}
+
+// Member is one Pokémon of the player's battle team as shown to the client
+type Member struct {
+	Name  string `json:"name"`
+	HP    int    `json:"hp"`
+	MaxHP int    `json:"max_hp"`
+}
+
+// Fighter is a Pokémon's battle state during a wild encounter
+type Fighter struct {
+	InstanceID   string // Identifies the player's Pokémon; empty for wild ones
+	Name         string
+	Types        []string
+	HP           int
+	MaxHP        int
+	Attack       int
+	Defense      int
+	SpAtk        int
+	SpDef        int
+	Speed        int
+	WhenAttacked map[string]string
+}
+
+// Battle is a wild encounter fought with the player's saved team
+type Battle struct {
+	Wild   *Fighter
+	Team   []*Fighter
+	Active int
+}
+
+// Ruleset holds the Pokebat battle rules that also apply to wild encounters
+type Ruleset struct {
+	TeamSize       int      `json:"team_size"`
+	LevelCap       int      `json:"level_cap"`       // 0 disables the cap
+	NormalizeLevel bool     `json:"normalize_level"` // Battle every Pokémon at LevelCap instead of skipping higher levels
+	BannedSpecies  []string `json:"banned_species"`  // Species names or pokedex IDs
+}
+
+// DefaultLevel is the level of wild Pokémon in areas without levels and of saved Pokémon without a
+// level. It is below the usual level cap so Pokémon saved before levels can still grow.
+const DefaultLevel = 30
+
+// StatsLevel is the level the Pokédex stats are for; battle stats scale from it to the Pokémon's level
+const StatsLevel = 50
+
+// Wallet is a player's money and items as saved in player_data.json
+type Wallet struct {
+	Money     int            `json:"money"`
+	Inventory map[string]int `json:"inventory"` // Item counts by shop key
+}
+
+// WalletView is a player's money and items as shown to the client
+type WalletView struct {
+	Money int       `json:"money"`
+	Bag   []BagItem `json:"bag"`
+}
+
+// BagItem is one kind of item the player owns
+type BagItem struct {
+	Key   string `json:"key"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	Count int    `json:"count"`
+}
+
+// Encounter tuning
+const (
+	defaultCatchRate = 45   // Used for species without a catch rate in the pokedex
+	fleeChance       = 0.25 // Chance that a wild Pokémon runs away after breaking free
+)
+
+// MapPokemon is what a client is told about a wild Pokémon on the map
+type MapPokemon struct {
+	SpawnID int    `json:"spawn_id"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Rarity  string `json:"rarity"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	area    string // Only sessions in this area are told about the spawn
+}
+
+// Trainer is a player's position as seen by everyone in the same area
+type Trainer struct {
+	Name string `json:"name"`
+	X    int    `json:"x"`
+	Y    int    `json:"y"`
+	area string // Sessions elsewhere are told the trainer left instead
+}
+
+// World is the single map shared by every connected player; guarded by mutex
+type World struct {
+	Wild      []Pokemon // Pokémon on the map, caught by whoever reaches them first
+	Sessions  map[string]*Session
+	nextSpawn int
+}
+
+// Session is one connected player; the server owns the position
+type Session struct {
+	Name      string
+	Conn      net.Conn
+	Area      string
+	X         int
+	Y         int
+	Caught    []Pokemon
+	Pokedex   map[string]DexEntry // Species the player has ever encountered, by Pokédex ID
+	Surfer    bool                // Owns a water-type Pokémon, so can cross water
+	Wallet    Wallet              // Money and items, as last saved
+	Encounter int                 // Spawn ID of the Pokémon being caught, 0 when exploring
+	Battle    *Battle             // The fight against that Pokémon
+	jobs      []storeJob          // Store I/O queued by the request being handled
+	send      chan interface{}    // Messages queued for the client
+	done      chan struct{}       // Closed once everything queued has been written
+}
+
+// ClientMessage is an intent sent by the Pokecat client
+type ClientMessage struct {
+	Type      string `json:"type"`                // "move", "attack", "switch", "throw", "heal", "flee" or "quit"
+	Direction string `json:"direction,omitempty"` // "up", "down", "left" or "right"
+	Ball      string `json:"ball,omitempty"`      // Key of the ball to throw
+	Slot      int    `json:"slot,omitempty"`      // Team index to switch to
+}
+
+// WorldState is the full view of the world sent to a client when it joins
+type WorldState struct {
+	Type         string              `json:"type"` // Always "state"
+	Area         string              `json:"area"`
+	Title        string              `json:"title"`
+	Width        int                 `json:"width"`
+	Height       int                 `json:"height"`
+	X            int                 `json:"x"`
+	Y            int                 `json:"y"`
+	Terrain      []string            `json:"terrain"` // One row of tiles per string
+	Pokemons     []MapPokemon        `json:"pokemons"`
+	Trainers     []Trainer           `json:"trainers"` // Everyone else in the area
+	Caught       int                 `json:"caught"`
+	Pokedex      map[string]DexEntry `json:"pokedex"` // Species the player has encountered, by Pokédex ID
+	Wallet       WalletView          `json:"wallet"`
+	Notification string              `json:"notification,omitempty"`
+	Error        string              `json:"error,omitempty"` // Set when the player cannot join
+}
+
+// WorldDelta is broadcast to every client whenever something on the map changes
+type WorldDelta struct {
+	Type         string       `json:"type"`               // Always "delta"
+	Trainers     []Trainer    `json:"trainers,omitempty"` // Trainers that joined or moved
+	Left         []string     `json:"left,omitempty"`     // Trainers that disconnected
+	Pokemons     []MapPokemon `json:"pokemons,omitempty"` // Newly spawned Pokémon
+	Removed      []int        `json:"removed,omitempty"`  // Spawn IDs that were caught
+	Caught       int          `json:"caught,omitempty"`   // The recipient's catch count, when it changed
+	Encounter    *Encounter   `json:"encounter,omitempty"` // The encounter the recipient is in
+	EncounterEnd bool         `json:"encounter_end,omitempty"`
+	Wallet       *WalletView  `json:"wallet,omitempty"` // The recipient's money and items, when they changed
+	Notification string       `json:"notification,omitempty"`
+	Closed       bool         `json:"closed,omitempty"` // The server ended the recipient's session
+}
+
+// DexEntry is what a player's Pokédex records about one species
+type DexEntry struct {
+	Caught      bool   `json:"caught"`
+	FirstSeen   string `json:"first_seen,omitempty"`   // RFC 3339; empty for catches made before the Pokédex kept times
+	FirstCaught string `json:"first_caught,omitempty"` // RFC 3339
 }
 
-// Player represents a player in the game
-type Player struct {
-	Conn net.Conn
+// DexCompletion summarises a player's Pokédex, for the hub and achievements
+type DexCompletion struct {
+	Seen          int     `json:"seen"`
+	Caught        int     `json:"caught"`
+	Total         int     `json:"total"`
+	SeenPercent   float64 `json:"seen_percent"`
+	CaughtPercent float64 `json:"caught_percent"`
 }
 
+// Size of each session's outgoing message queue; a client that falls this far behind is dropped
+const sendQueueSize = 64
+
 var (
 	pokemons []Pokemon
-	mutex    sync.Mutex // Mutex for safe access to shared data
+	world    = &World{Sessions: make(map[string]*Session)}
+	rng      *rand.Rand // Seedable source for spawns, battles and catches; guarded by mutex
+	rules    *Ruleset
+	spawns   *SpawnConfig
+	natures  map[string]Nature
+	shop     *store.Shop
+	worldMap *WorldMap
+	areas    = make(map[string]*Area)
+	mutex    sync.Mutex     // Mutex for safe access to shared data
+	players  store.Store    // Every player's saved Pokémon, Pokédex, money and items
+	accounts store.Accounts // Usernames and passwords players log in with
 )
 
 func main() {
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed for spawns, battles and catch rolls")
+	rulesFile := flag.String("rules", "../rules.json", "battle rules shared with Pokebat")
+	spawnsFile := flag.String("spawns", "../spawns.json", "spawn rates and rarity tiers")
+	mapFile := flag.String("map", "../map.json", "areas, terrain and warps of the world")
+	naturesFile := flag.String("natures", "../natures.json", "natures rolled for caught Pokémon")
+	shopFile := flag.String("shop", "../shop.json", "items, prices and rewards")
+	playersFile := flag.String("players", store.DataPath("player_data.json"), "saved players, shared with the hub and Pokebat")
+	accountsFile := flag.String("accounts", store.DataPath("accounts.json"), "accounts players log in with")
+	dbFile := flag.String("db", "", "SQLite database to use instead of the accounts and players files, filled by dbimport")
+	flag.Parse()
+	players, accounts = store.OpenFile(*playersFile), store.OpenAccounts(*accountsFile)
+	if *dbFile == "" {
+		if err := store.RequireFiles(*playersFile, *accountsFile); err != nil {
+			log.Fatalf("Failed to open player data: %v", err)
+		}
+	} else {
+		db, err := store.OpenSQL(*dbFile)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.Close()
+		players, accounts = db, db
+	}
+	rng = rand.New(rand.NewSource(*seed))
+	log.Printf("Using random seed %d", *seed)
+
 	// Load Pokémon data from pokedex.json file
 	if err := loadPokemonData("../pokedex.json"); err != nil {
 		log.Fatalf("Failed to load Pokémon data: %v", err)
 	}
+	var err error
+	if rules, err = loadRuleset(*rulesFile); err != nil {
+		log.Fatalf("Failed to load battle rules: %v", err)
+	}
+	if spawns, err = loadSpawnConfig(*spawnsFile); err != nil {
+		log.Fatalf("Failed to load spawn config: %v", err)
+	}
+	if err := loadWorldMap(*mapFile); err != nil {
+		log.Fatalf("Failed to load map: %v", err)
+	}
+	if err := loadNatures(*naturesFile); err != nil {
+		log.Fatalf("Failed to load natures: %v", err)
+	}
+	if shop, err = loadShop(*shopFile); err != nil {
+		log.Fatalf("Failed to load shop: %v", err)
+	}
 
 	// Start the server
 	listener, err := net.Listen("tcp", ":8080")
@@ -64,6 +430,7 @@ func main() {
 		os.Exit(0)
 	}()
 
+	go world.spawnLoop()
 	fmt.Println("Server started. Waiting for players...")
 
 	// Accept incoming connections
@@ -93,108 +460,1702 @@ func loadPokemonData(filename string) error {
 	return nil
 }
 
-// chooseRandomPokemons selects unique random Pokémon and ensures positions are within the grid
-func chooseRandomPokemons() []Pokemon {
-	selectedPokemons := make([]Pokemon, 0, PokemonsPerPlayer)
-	uniqueIndexes := make(map[int]struct{}) // Track selected Pokémon to avoid duplicates
-
-	for len(selectedPokemons) < PokemonsPerPlayer {
-		index := rand.Intn(len(pokemons))
-		if _, exists := uniqueIndexes[index]; exists {
-			continue
-		}
-		uniqueIndexes[index] = struct{}{}
-
-		pokemon := pokemons[index]
-		pokemon.X = rand.Intn(GridSize) // Ensure within grid bounds
-		pokemon.Y = rand.Intn(GridSize)
-		selectedPokemons = append(selectedPokemons, pokemon)
-	}
-
-	return selectedPokemons
-}
-
-// handlePlayer handles each player's connection
+// handlePlayer runs one player's connection. The client only sends intents such as moves and throws;
+// the server validates every step, resolves captures on the shared map and broadcasts the changes.
 func handlePlayer(conn net.Conn) {
 	defer func() {
 		log.Printf("Player disconnected: %s", conn.RemoteAddr())
 		conn.Close()
 	}()
-	if !authenticatePlayer(conn) {
+	playerName, ok := authenticatePlayer(conn)
+	if !ok {
 		log.Printf("Authentication failed for %s", conn.RemoteAddr())
-		conn.Close()
 		return
 	}
+
+	session := &Session{
+		Name: playerName,
+		Conn: conn,
+		Area: worldMap.Start.Area,
+		X:    worldMap.Start.X,
+		Y:    worldMap.Start.Y,
+		Pokedex: make(map[string]DexEntry),
+		send:    make(chan interface{}, sendQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	// Trainers who already own a water-type Pokémon can surf from the start
+	wallet, err := loadWallet(playerName)
+	if err != nil {
+		log.Printf("Failed to load wallet of %s: %v", playerName, err)
+	}
+	session.Wallet = wallet
+	saved, err := loadSavedPlayer(playerName)
+	if err != nil {
+		log.Printf("Failed to load saved Pokémon for %s: %v", playerName, err)
+	} else if saved != nil {
+		session.Pokedex = saved.dex()
+		for _, p := range saved.Pokemons {
+			if hasType(p, "water") {
+				session.Surfer = true
+				break
+			}
+		}
+	}
+
 	mutex.Lock()
-	selectedPokemons := chooseRandomPokemons()
+	if _, exists := world.Sessions[playerName]; exists {
+		mutex.Unlock()
+		log.Printf("Player %s is already on the map", playerName)
+		json.NewEncoder(conn).Encode(WorldState{Type: "state", Error: "You are already on the map."})
+		return
+	}
+	// Top the map up for the newcomer straight away rather than waiting for the next wave
+	world.Sessions[playerName] = session
+	spawned := world.spawn(world.missing())
+	session.queue(world.state(session))
+	world.broadcast(session, WorldDelta{Type: "delta", Trainers: []Trainer{session.trainer()}, Pokemons: spawned},
+		fmt.Sprintf("%s joined the map.", playerName))
 	mutex.Unlock()
+	log.Printf("%s joined %s; %d Pokémon are now wild", playerName, session.Area, len(world.Wild))
 
-	// Convert Pokémon data to JSON
-	data, err := json.Marshal(selectedPokemons)
-	if err != nil {
-		log.Printf("Failed to serialize Pokémon data for %s: %v", conn.RemoteAddr(), err)
+	go session.writeLoop()
+	defer func() {
+		mutex.Lock()
+		world.endEncounter(session)
+		delete(world.Sessions, playerName)
+		world.broadcast(nil, WorldDelta{Type: "delta", Left: []string{playerName}}, fmt.Sprintf("%s left the map.", playerName))
+		close(session.send)
+		mutex.Unlock()
+
+		// Let the goodbye message and any last updates reach the client before hanging up
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		<-session.done
+	}()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var message ClientMessage
+		if err := decoder.Decode(&message); err != nil {
+			log.Printf("Failed to read message from %s: %v", playerName, err)
+			return
+		}
+
+		switch message.Type {
+		case "move":
+			mutex.Lock()
+			world.move(session, message.Direction)
+			mutex.Unlock()
+		case "attack":
+			mutex.Lock()
+			world.attack(session)
+			mutex.Unlock()
+		case "switch":
+			mutex.Lock()
+			world.switchTo(session, message.Slot)
+			mutex.Unlock()
+		case "throw":
+			mutex.Lock()
+			world.throw(session, message.Ball)
+			mutex.Unlock()
+		case "heal":
+			mutex.Lock()
+			world.heal(session)
+			mutex.Unlock()
+		case "flee":
+			mutex.Lock()
+			world.flee(session)
+			mutex.Unlock()
+		case "quit":
+			log.Printf("%s quit with %d Pokémon caught", playerName, len(session.Caught))
+			mutex.Lock()
+			session.queue(WorldDelta{
+				Type:         "delta",
+				Closed:       true,
+				Notification: fmt.Sprintf("You caught %d Pokémon this session. Every catch is saved. See you next time!", len(session.Caught)),
+			})
+			mutex.Unlock()
+			return
+		default:
+			mutex.Lock()
+			session.queue(WorldDelta{Type: "delta", Notification: fmt.Sprintf("Unknown request: %s", message.Type)})
+			mutex.Unlock()
+		}
+		session.runJobs()
+	}
+}
+
+// writeLoop sends queued messages to the client until the session ends
+func (s *Session) writeLoop() {
+	defer close(s.done)
+	encoder := json.NewEncoder(s.Conn)
+	for message := range s.send {
+		if err := encoder.Encode(message); err != nil {
+			log.Printf("Failed to send update to %s: %v", s.Name, err)
+			s.Conn.Close()
+			// Keep draining so the world never blocks on this session
+			for range s.send {
+			}
+			return
+		}
+	}
+}
+
+// storeJob is store I/O needed by a request. It runs after the request has released mutex, so a slow
+// store, such as one waiting while the hub holds the player data lock for a trade, holds up only this
+// player rather than the whole world. It returns a function that applies its result with mutex held
+// again, or nil if there is nothing to apply.
+type storeJob func() (apply func())
+
+// later queues store I/O to run once the current request releases mutex. Must be called with mutex held.
+// A session handles one request at a time, so nothing else the player does happens in between.
+func (s *Session) later(job storeJob) {
+	s.jobs = append(s.jobs, job)
+}
+
+// runJobs runs the store I/O queued by the last request in order, applying each result under mutex.
+// Applying a result may queue more I/O, which runs next.
+func (s *Session) runJobs() {
+	for {
+		mutex.Lock()
+		jobs := s.jobs
+		s.jobs = nil
+		mutex.Unlock()
+		if len(jobs) == 0 {
+			return
+		}
+		for _, job := range jobs {
+			if apply := job(); apply != nil {
+				mutex.Lock()
+				apply()
+				mutex.Unlock()
+			}
+		}
+	}
+}
+
+// recordDex saves one of the session's Pokédex entries once the current request releases mutex.
+// Must be called with mutex held.
+func (s *Session) recordDex(id string, what string) {
+	entries := map[string]DexEntry{id: s.Pokedex[id]}
+	s.later(func() func() {
+		if err := savePokedex(s.Name, entries); err != nil {
+			log.Printf("Failed to record %s for %s: %v", what, s.Name, err)
+		}
+		return nil
+	})
+}
+
+// queue hands a message to the session's writer without blocking the world.
+// Must be called with mutex held, since the queue is closed under it.
+func (s *Session) queue(message interface{}) {
+	select {
+	case s.send <- message:
+	default:
+		log.Printf("%s is not keeping up with updates, disconnecting", s.Name)
+		s.Conn.Close()
+	}
+}
+
+// trainer returns the session's position as shown to other players
+func (s *Session) trainer() Trainer {
+	return Trainer{Name: s.Name, X: s.X, Y: s.Y, area: s.Area}
+}
+
+// spawn places new Pokémon, weighted by rarity, on free cells of the map and returns them as clients see them.
+// Larger areas get proportionally more spawns.
+func (w *World) spawn(count int) []MapPokemon {
+	spawned := make([]MapPokemon, 0, max(count, 0))
+	for i := 0; i < count; i++ {
+		area := randomArea()
+		x, y := rng.Intn(area.Width), rng.Intn(area.Height)
+		for tries := 0; (!canSpawnOn(area.tileAt(x, y)) || w.spawnAt(area.Name, x, y) != nil) && tries < 20; tries++ {
+			x, y = rng.Intn(area.Width), rng.Intn(area.Height)
+		}
+		// Give up on this spawn rather than stack two Pokémon on one cell
+		if !canSpawnOn(area.tileAt(x, y)) || w.spawnAt(area.Name, x, y) != nil {
+			continue
+		}
+
+		pokemon, rarity := pickSpecies(area.tileAt(x, y))
+		pokemon.Rarity = rarity
+		pokemon.Level = area.wildLevel()
+		pokemon.Area = area.Name
+		pokemon.X, pokemon.Y = x, y
+		if spawns.LifetimeSeconds > 0 {
+			pokemon.ExpiresAt = time.Now().Add(time.Duration(spawns.LifetimeSeconds) * time.Second)
+		}
+
+		w.nextSpawn++
+		pokemon.SpawnID = w.nextSpawn
+		w.Wild = append(w.Wild, pokemon)
+		spawned = append(spawned, mapPokemon(pokemon))
+		log.Printf("Spawned %s Pokémon: ID=%s, Name=%s in %s at (%d, %d) on %c", rarity, pokemon.ID, pokemon.Name, area.Name, x, y, area.tileAt(x, y))
+	}
+	return spawned
+}
+
+// missing returns how many Pokémon the map is short of for the players connected
+func (w *World) missing() int {
+	return spawns.MaxWildPerPlayer*len(w.Sessions) - len(w.Wild)
+}
+
+// move applies a movement intent, keeping the player on the grid, then starts an encounter
+// if the player stepped onto a wild Pokémon, and tells every session what changed
+func (w *World) move(s *Session, direction string) {
+	if s.Encounter != 0 {
+		s.queue(WorldDelta{Type: "delta", Notification: "You can't run off mid-encounter! Battle, throw a ball or flee."})
+		return
+	}
+
+	x, y := s.X, s.Y
+	switch direction {
+	case "up":
+		y--
+	case "down":
+		y++
+	case "left":
+		x--
+	case "right":
+		x++
+	default:
+		s.queue(WorldDelta{Type: "delta", Notification: fmt.Sprintf("Unknown direction: %s", direction)})
+		return
+	}
+	area := areas[s.Area]
+	if x < 0 || x >= area.Width || y < 0 || y >= area.Height {
 		return
 	}
 
-	// Send JSON data to client
-	if _, err := conn.Write(data); err != nil {
-		log.Printf("Failed to send Pokémon data to %s: %v", conn.RemoteAddr(), err)
+	// Terrain decides where a trainer can go
+	switch area.tileAt(x, y) {
+	case TileWall:
+		s.queue(WorldDelta{Type: "delta", Notification: "A rock wall blocks the way."})
+		return
+	case TileWater:
+		if !s.Surfer {
+			s.queue(WorldDelta{Type: "delta", Notification: "The water is too deep. You need a water-type Pokémon to surf."})
+			return
+		}
+	}
+	s.X, s.Y = x, y
+	if warp := area.warpAt(x, y); warp != nil {
+		destination := areas[warp.To]
+		w.place(s, destination.Name, warp.ToX, warp.ToY, fmt.Sprintf("You entered %s.", destination.Title))
 		return
 	}
 
-	log.Printf("Sent %d Pokémon to %s", len(selectedPokemons), conn.RemoteAddr())
-	for _, pokemon := range selectedPokemons {
-		log.Printf("Sent Pokémon: ID=%s, Name=%s",
-			pokemon.ID, pokemon.Name)
+	delta := WorldDelta{Type: "delta", Trainers: []Trainer{s.trainer()}}
+	spawn := w.spawnAt(s.Area, s.X, s.Y)
+	if spawn == nil {
+		w.broadcast(s, delta, "")
+		found := shop.Rewards.PokecatFind
+		if found <= 0 || rng.Float64() >= shop.Rewards.PokecatFindChance {
+			s.queue(delta)
+			return
+		}
+		s.later(func() func() {
+			wallet, err := updateWallet(s.Name, addMoney(found))
+			if err != nil {
+				log.Printf("Failed to give %s ₽%d: %v", s.Name, found, err)
+			}
+			return func() {
+				if err == nil {
+					s.Wallet = wallet
+					delta.Wallet = s.walletView()
+					delta.Notification = fmt.Sprintf("You found ₽%d on the ground!", found)
+				}
+				s.queue(delta)
+			}
+		})
+		return
+	}
+	if spawn.EngagedBy != "" {
+		w.broadcast(s, delta, "")
+		delta.Notification = fmt.Sprintf("%s is already trying to catch %s!", spawn.EngagedBy, spawn.Name)
+		s.queue(delta)
+		return
 	}
+
+	// The first trainer to reach a spawn gets the encounter, fought with a freshly healed team. The spawn
+	// is held for them while their team loads; engaged spawns never wander off.
+	spawn.EngagedBy = s.Name
+	s.Encounter = spawn.SpawnID
+	spawnID := spawn.SpawnID
+	s.later(func() func() {
+		team, err := loadTeam(s.Name)
+		if err != nil {
+			log.Printf("Failed to load battle team for %s: %v", s.Name, err)
+		}
+		// Pick up anything bought at the hub's shop since the player joined
+		wallet, err := loadWallet(s.Name)
+		if err != nil {
+			log.Printf("Failed to load wallet of %s: %v", s.Name, err)
+		}
+		return func() { w.startEncounter(s, spawnID, delta, team, wallet, err == nil) }
+	})
 }
-// authenticatePlayer authenticates the player using the provided credentials
-func authenticatePlayer(conn net.Conn) bool {
-	buffer := make([]byte, 2048)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		log.Printf("Failed to read authentication data: %v", err)
-		return false
+
+// startEncounter begins the battle against a spawn the session is holding, once its team has loaded
+func (w *World) startEncounter(s *Session, spawnID int, delta WorldDelta, team []*Fighter, wallet Wallet, loaded bool) {
+	spawn := w.spawnByID(spawnID)
+	if spawn == nil || s.Encounter != spawnID {
+		s.queue(delta)
+		return
 	}
+	if loaded {
+		s.Wallet = wallet
+	}
+	if _, seen := s.Pokedex[spawn.ID]; !seen {
+		s.Pokedex[spawn.ID] = DexEntry{FirstSeen: time.Now().UTC().Format(time.RFC3339)}
+		s.recordDex(spawn.ID, spawn.Name+" as seen")
+	}
+	s.Battle = &Battle{Wild: newFighter(*spawn), Team: team}
+	w.broadcast(s, delta, fmt.Sprintf("%s found a wild %s!", s.Name, spawn.Name))
+	delta.Encounter = s.Battle.view(spawn, s.Wallet)
+	delta.Wallet = s.walletView()
+	delta.Notification = fmt.Sprintf("A wild %s appeared!", spawn.Name)
+	if len(team) == 0 {
+		delta.Notification += " You have no Pokémon to battle with, so throw a ball or flee."
+	} else {
+		delta.Notification += fmt.Sprintf(" Go, %s!", team[0].Name)
+	}
+	s.queue(delta)
+}
 
-	var authData map[string]string
-	if err := json.Unmarshal(buffer[:n], &authData); err != nil {
-		log.Printf("Failed to parse authentication data: %v", err)
-		return false
+// attack has the player's active Pokémon trade blows with the wild one, faster Pokémon first
+func (w *World) attack(s *Session) {
+	battle := s.Battle
+	if battle == nil {
+		s.queue(WorldDelta{Type: "delta", Notification: "There is nothing to battle."})
+		return
+	}
+	if len(battle.Team) == 0 {
+		s.queue(WorldDelta{Type: "delta", Notification: "You have no Pokémon to battle with."})
+		return
 	}
 
-	accounts, err := loadAccountsData("../accounts.json")
-	if err != nil {
-		log.Printf("Failed to load accounts data: %v", err)
-		return false
+	player := battle.Team[battle.Active]
+	first, second := player, battle.Wild
+	if battle.Wild.Speed > player.Speed || (battle.Wild.Speed == player.Speed && rng.Intn(2) == 0) {
+		first, second = battle.Wild, player
 	}
 
-	for _, account := range accounts {
-		if account["Name"] == authData["name"] && account["Password"] == authData["password"] {
-			response := map[string]string{"status": "success"}
-			responseBytes, _ := json.Marshal(response)
-			conn.Write(responseBytes)
-			return true
+	turn := []string{hit(first, second)}
+	if second.HP > 0 {
+		turn = append(turn, hit(second, first))
+	}
+	w.afterTurn(s, turn)
+}
+
+// switchTo sends in another healthy team member; the wild Pokémon gets a free attack
+func (w *World) switchTo(s *Session, slot int) {
+	battle := s.Battle
+	if battle == nil {
+		s.queue(WorldDelta{Type: "delta", Notification: "There is nothing to battle."})
+		return
+	}
+	if slot < 0 || slot >= len(battle.Team) || slot == battle.Active || battle.Team[slot].HP <= 0 {
+		s.queue(WorldDelta{Type: "delta", Notification: "That Pokémon can't battle right now."})
+		return
+	}
+
+	battle.Active = slot
+	turn := []string{fmt.Sprintf("Go, %s!", battle.Team[slot].Name)}
+	turn = append(turn, hit(battle.Wild, battle.Team[slot]))
+	w.afterTurn(s, turn)
+}
+
+// afterTurn resolves fainting at the end of a turn and sends the player the result.
+// A fainted wild Pokémon leaves the map uncaught; a wiped out team sends the player back to the start.
+func (w *World) afterTurn(s *Session, turn []string) {
+	battle := s.Battle
+	spawn := w.spawnByID(s.Encounter)
+
+	if battle.Wild.HP <= 0 {
+		fainted := *spawn
+		s.Encounter, s.Battle = 0, nil
+		log.Printf("%s knocked out the wild %s", s.Name, fainted.Name)
+		turn = append(turn, fmt.Sprintf("The wild %s fainted and can no longer be caught.", fainted.Name))
+		delta := w.removeSpawn(fainted.SpawnID)
+		w.broadcast(s, delta, fmt.Sprintf("%s knocked out the wild %s.", s.Name, fainted.Name))
+
+		// The winner levels up and the player is paid once the request releases mutex
+		winner := *battle.Team[battle.Active]
+		reward := shop.Rewards.PokecatKnockout
+		s.later(func() func() {
+			level, evolved, levelErr := levelUp(s.Name, winner.InstanceID)
+			if levelErr != nil {
+				log.Printf("Failed to level up %s for %s: %v", winner.Name, s.Name, levelErr)
+			}
+			var wallet Wallet
+			var earnErr error
+			if reward > 0 {
+				if wallet, earnErr = updateWallet(s.Name, addMoney(reward)); earnErr != nil {
+					log.Printf("Failed to give %s ₽%d: %v", s.Name, reward, earnErr)
+				}
+			}
+			return func() {
+				if levelErr == nil {
+					turn = append(turn, w.leveledUp(s, winner.Name, level, evolved)...)
+				}
+				if reward > 0 && earnErr == nil {
+					s.Wallet = wallet
+					turn = append(turn, fmt.Sprintf("You earned ₽%d.", reward))
+				}
+				mine := delta
+				mine.EncounterEnd = true
+				mine.Wallet = s.walletView()
+				mine.Notification = strings.Join(turn, "\n")
+				s.queue(mine)
+			}
+		})
+		return
+	}
+
+	if active := battle.Team[battle.Active]; active.HP <= 0 {
+		turn = append(turn, fmt.Sprintf("%s fainted!", active.Name))
+		next := battle.nextHealthy()
+		if next < 0 {
+			w.endEncounter(s)
+			log.Printf("%s was defeated by the wild %s", s.Name, spawn.Name)
+			w.broadcast(s, WorldDelta{Type: "delta"}, fmt.Sprintf("%s was defeated by a wild %s.", s.Name, spawn.Name))
+			w.place(s, worldMap.Start.Area, worldMap.Start.X, worldMap.Start.Y,
+				strings.Join(append(turn, "You have no Pokémon left to fight! You hurried back to the start."), "\n"))
+			return
 		}
+		battle.Active = next
+		turn = append(turn, fmt.Sprintf("Go, %s!", battle.Team[next].Name))
 	}
 
-	log.Println("Authentication failed. Exiting.")
-	response := map[string]string{"status": "failure"}
-	responseBytes, _ := json.Marshal(response)
-	conn.Write(responseBytes)
-	return false
+	s.queue(WorldDelta{Type: "delta", Encounter: battle.view(spawn, s.Wallet), Wallet: s.walletView(), Notification: strings.Join(turn, "\n")})
 }
 
-// loadAccountsData loads account data from a JSON file
-func loadAccountsData(filename string) ([]map[string]string, error) {
-	file, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load accounts data file: %v", err)
+// leveledUp applies a saved level-up of the team member that knocked out a wild Pokémon, which evolved
+// if it reached the level its species evolves at, and returns the notes telling the player
+func (w *World) leveledUp(s *Session, name string, level int, evolved *Pokemon) []string {
+	if level == 0 {
+		return nil
+	}
+	notes := []string{fmt.Sprintf("%s grew to level %d!", name, level)}
+	if evolved == nil {
+		return notes
+	}
+
+	log.Printf("%s's %s evolved into %s", s.Name, name, evolved.Name)
+	notes = append(notes, fmt.Sprintf("What? %s evolved into %s!", name, evolved.Name))
+	if entry := s.Pokedex[evolved.ID]; !entry.Caught {
+		now := time.Now().UTC().Format(time.RFC3339)
+		if entry.FirstSeen == "" {
+			entry.FirstSeen = now
+		}
+		entry.Caught, entry.FirstCaught = true, now
+		s.Pokedex[evolved.ID] = entry
+		s.recordDex(evolved.ID, evolved.Name+" as caught")
+	}
+	if hasType(*evolved, "water") && !s.Surfer {
+		s.Surfer = true
+		notes = append(notes, fmt.Sprintf("%s can carry you across water now!", evolved.Name))
+	}
+	return notes
+}
+
+// throw throws a ball at the Pokémon the player is encountering
+func (w *World) throw(s *Session, ballKey string) {
+	spawn := w.spawnByID(s.Encounter)
+	if spawn == nil {
+		s.queue(WorldDelta{Type: "delta", Notification: "There is nothing to throw a ball at."})
+		return
+	}
+	ball, ok := findBall(ballKey)
+	if !ok {
+		s.queue(WorldDelta{Type: "delta", Notification: fmt.Sprintf("Unknown ball: %s", ballKey)})
+		return
+	}
+	s.later(func() func() {
+		wallet, err := updateWallet(s.Name, takeItem(ball.Key))
+		return func() {
+			if err != nil {
+				s.queue(WorldDelta{Type: "delta", Notification: err.Error()})
+				return
+			}
+			s.Wallet = wallet
+			w.landThrow(s, ball)
+		}
+	})
+}
+
+// landThrow resolves a ball the player has used up: the Pokémon is caught, flees or breaks free
+func (w *World) landThrow(s *Session, ball Ball) {
+	spawn := w.spawnByID(s.Encounter)
+	battle := s.Battle
+	if spawn == nil || battle == nil {
+		s.queue(WorldDelta{Type: "delta", Notification: "There is nothing to throw a ball at."})
+		return
+	}
+	if rng.Float64() < catchChance(catchRate(*spawn), ball, battle.Wild.HP, battle.Wild.MaxHP) {
+		caught := *spawn
+		caught.IVs, caught.Nature = rollIndividuals()
+		s.Caught = append(s.Caught, caught)
+		s.Encounter, s.Battle = 0, nil
+		log.Printf("%s caught %s (ID: %s) using a %s", s.Name, caught.Name, caught.ID, ball.Name)
+
+		delta := w.removeSpawn(caught.SpawnID)
+		mine := delta
+		mine.Caught = len(s.Caught)
+		mine.EncounterEnd = true
+		mine.Wallet = s.walletView()
+		mine.Notification = fmt.Sprintf("Gotcha! You caught a Pokémon: %s (ID: %s)! Its nature is %s.",
+			caught.Name, caught.ID, natures[caught.Nature].Name)
+		if entry := s.Pokedex[caught.ID]; !entry.Caught {
+			entry.Caught = true
+			entry.FirstCaught = time.Now().UTC().Format(time.RFC3339)
+			s.Pokedex[caught.ID] = entry
+		}
+		entries := map[string]DexEntry{caught.ID: s.Pokedex[caught.ID]}
+		if hasType(caught, "water") && !s.Surfer {
+			s.Surfer = true
+			mine.Notification += fmt.Sprintf(" %s can carry you across water now!", caught.Name)
+		}
+		w.broadcast(s, delta, fmt.Sprintf("%s caught %s!", s.Name, caught.Name))
+
+		// Persist every catch before the player's next request so nothing is lost if the session ends abruptly
+		s.later(func() func() {
+			saveErr := savePlayerData(s.Name, []Pokemon{caught})
+			if saveErr != nil {
+				log.Printf("Failed to save %s for %s: %v", caught.Name, s.Name, saveErr)
+			}
+			if err := savePokedex(s.Name, entries); err != nil {
+				log.Printf("Failed to record %s as caught by %s: %v", caught.Name, s.Name, err)
+			}
+			return func() {
+				if saveErr != nil {
+					mine.Notification += " (It could not be saved, please tell the server admin.)"
+				}
+				s.queue(mine)
+			}
+		})
+		return
+	}
+
+	if rng.Float64() < fleeChance {
+		fled := *spawn
+		s.Encounter, s.Battle = 0, nil
+		log.Printf("%s fled from %s", fled.Name, s.Name)
+
+		delta := w.removeSpawn(fled.SpawnID)
+		mine := delta
+		mine.EncounterEnd = true
+		mine.Wallet = s.walletView()
+		mine.Notification = fmt.Sprintf("Oh no! %s broke free from the %s and fled!", fled.Name, ball.Name)
+		s.queue(mine)
+		w.broadcast(s, delta, fmt.Sprintf("The wild %s fled from %s.", fled.Name, s.Name))
+		return
+	}
+
+	// A Pokémon that breaks free gets to attack back
+	turn := []string{fmt.Sprintf("Argh! %s broke free from the %s!", spawn.Name, ball.Name)}
+	if len(battle.Team) == 0 {
+		s.queue(WorldDelta{Type: "delta", Encounter: battle.view(spawn, s.Wallet), Wallet: s.walletView(), Notification: turn[0]})
+		return
+	}
+	turn = append(turn, hit(battle.Wild, battle.Team[battle.Active]))
+	w.afterTurn(s, turn)
+}
+
+// heal uses the player's weakest potion that restores all of the active Pokémon's lost HP, or their
+// strongest if none does. Drinking it takes the turn, so the wild Pokémon attacks.
+func (w *World) heal(s *Session) {
+	battle := s.Battle
+	if battle == nil || len(battle.Team) == 0 {
+		s.queue(WorldDelta{Type: "delta", Notification: "There is no Pokémon to heal."})
+		return
+	}
+	active := battle.Team[battle.Active]
+	lost := active.MaxHP - active.HP
+	if lost == 0 {
+		s.queue(WorldDelta{Type: "delta", Notification: fmt.Sprintf("%s's HP is already full.", active.Name)})
+		return
+	}
+
+	var best string
+	for key, count := range s.Wallet.Inventory {
+		item := shop.Items[key]
+		if item.Kind != "potion" || count <= 0 {
+			continue
+		}
+		current := shop.Items[best]
+		switch {
+		case best == "":
+			best = key
+		case item.Heal >= lost && (current.Heal < lost || item.Heal < current.Heal):
+			best = key
+		case current.Heal < lost && item.Heal > current.Heal:
+			best = key
+		}
+	}
+	if best == "" {
+		s.queue(WorldDelta{Type: "delta", Notification: "You have no potions. Buy some at the hub's shop."})
+		return
+	}
+	s.later(func() func() {
+		wallet, err := updateWallet(s.Name, takeItem(best))
+		return func() {
+			if err != nil {
+				s.queue(WorldDelta{Type: "delta", Notification: err.Error()})
+				return
+			}
+			s.Wallet = wallet
+			w.drinkPotion(s, best)
+		}
+	})
+}
+
+// drinkPotion heals the active Pokémon with a potion the player has used up, then the wild Pokémon attacks
+func (w *World) drinkPotion(s *Session, best string) {
+	battle := s.Battle
+	if battle == nil {
+		s.queue(WorldDelta{Type: "delta", Notification: "There is no Pokémon to heal."})
+		return
+	}
+	active := battle.Team[battle.Active]
+	lost := active.MaxHP - active.HP
+	healed := min(shop.Items[best].Heal, lost)
+	active.HP += healed
+	turn := []string{fmt.Sprintf("You used a %s. %s recovered %d HP.", shop.Items[best].Name, active.Name, healed)}
+	turn = append(turn, hit(battle.Wild, active))
+	w.afterTurn(s, turn)
+}
+
+// flee ends the player's encounter, leaving the Pokémon on the map for anyone to find
+func (w *World) flee(s *Session) {
+	if s.Encounter == 0 {
+		return
 	}
-	var accounts []map[string]string
-	if err := json.Unmarshal(file, &accounts); err != nil {
-		return nil, fmt.Errorf("failed to parse accounts data: %v", err)
+	name := w.spawnByID(s.Encounter).Name
+	w.endEncounter(s)
+	s.queue(WorldDelta{Type: "delta", EncounterEnd: true, Notification: fmt.Sprintf("You got away from the wild %s.", name)})
+}
+
+// endEncounter releases the Pokémon a session was trying to catch
+func (w *World) endEncounter(s *Session) {
+	if spawn := w.spawnByID(s.Encounter); spawn != nil {
+		spawn.EngagedBy = ""
+	}
+	s.Encounter, s.Battle = 0, nil
+}
+
+// removeSpawn takes a Pokémon off the map and returns the delta announcing it
+func (w *World) removeSpawn(spawnID int) WorldDelta {
+	for i, p := range w.Wild {
+		if p.SpawnID == spawnID {
+			w.Wild = append(w.Wild[:i], w.Wild[i+1:]...)
+			break
+		}
 	}
-	log.Printf("Loaded %d accounts from %s", len(accounts), filename)
-	return accounts, nil
+	return WorldDelta{Type: "delta", Removed: []int{spawnID}}
+}
+
+// spawnLoop runs the spawn scheduler: every interval, Pokémon past their lifetime leave the map
+// and a new wave tops it back up, until it holds max_wild_per_player for each connected player
+func (w *World) spawnLoop() {
+	for range time.Tick(time.Duration(spawns.IntervalSeconds) * time.Second) {
+		mutex.Lock()
+		delta := WorldDelta{Type: "delta"}
+		var notes []string
+
+		// Spawns being caught stay until the encounter ends
+		now := time.Now()
+		wild := w.Wild[:0]
+		for _, p := range w.Wild {
+			if !p.ExpiresAt.IsZero() && now.After(p.ExpiresAt) && p.EngagedBy == "" {
+				delta.Removed = append(delta.Removed, p.SpawnID)
+				notes = append(notes, fmt.Sprintf("The wild %s in %s wandered off.", p.Name, areas[p.Area].Title))
+				log.Printf("Despawned Pokémon: ID=%s, Name=%s", p.ID, p.Name)
+				continue
+			}
+			wild = append(wild, p)
+		}
+		w.Wild = wild
+
+		if missing := w.missing(); missing > 0 {
+			delta.Pokemons = w.spawn(min(missing, spawns.BatchSize))
+			names := make([]string, 0, len(delta.Pokemons))
+			for _, p := range delta.Pokemons {
+				names = append(names, fmt.Sprintf("%s in %s", p.Name, areas[p.area].Title))
+			}
+			notes = append(notes, fmt.Sprintf("Wild Pokémon appeared: %s!", strings.Join(names, ", ")))
+		}
+
+		if len(notes) > 0 {
+			w.broadcast(nil, delta, strings.Join(notes, " "))
+		}
+		mutex.Unlock()
+	}
+}
+
+// loadNatures reads the natures a caught Pokémon can have
+func loadNatures(filename string) error {
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read natures file: %v", err)
+	}
+	if err := json.Unmarshal(file, &natures); err != nil {
+		return fmt.Errorf("failed to parse natures file: %v", err)
+	}
+	if len(natures) == 0 {
+		return fmt.Errorf("natures file lists no natures")
+	}
+	for key, nature := range natures {
+		for _, stat := range []string{nature.Increased, nature.Decreased} {
+			if stat != "" && !containsStat(stat) {
+				return fmt.Errorf("nature %s changes unknown stat %q", key, stat)
+			}
+		}
+	}
+	return nil
+}
+
+// loadShop reads the item catalog and rewards, making sure every ball the client can throw is in it
+func loadShop(filename string) (*store.Shop, error) {
+	config, err := store.LoadShop(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, ball := range balls {
+		if config.Items[ball.Key].Kind != "ball" {
+			return nil, fmt.Errorf("shop has no ball %q", ball.Key)
+		}
+	}
+	return config, nil
+}
+
+// containsStat reports whether a name is one of the battle stats
+func containsStat(name string) bool {
+	for _, stat := range statNames {
+		if stat == name {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSpawnConfig reads the spawn scheduler settings and sorts every species into its rarity tier
+func loadSpawnConfig(filename string) (*SpawnConfig, error) {
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load spawn config: %v", err)
+	}
+
+	config := &SpawnConfig{}
+	if err := json.Unmarshal(file, config); err != nil {
+		return nil, fmt.Errorf("failed to parse spawn config: %v", err)
+	}
+	if config.IntervalSeconds < 1 || config.BatchSize < 1 || config.MaxWildPerPlayer < 1 {
+		return nil, fmt.Errorf("interval_seconds, batch_size and max_wild_per_player must be at least 1")
+	}
+	if config.LifetimeSeconds < 0 {
+		return nil, fmt.Errorf("lifetime_seconds cannot be negative")
+	}
+	if config.RarityBy != "base_stat_total" && config.RarityBy != "exp" {
+		return nil, fmt.Errorf("rarity_by must be base_stat_total or exp, got %q", config.RarityBy)
+	}
+	if len(config.Tiers) == 0 {
+		return nil, fmt.Errorf("at least one rarity tier is required")
+	}
+
+	for index, p := range pokemons {
+		score := rarityScore(p, config.RarityBy)
+		for i := range config.Tiers {
+			tier := &config.Tiers[i]
+			if tier.Max == 0 || score <= tier.Max || i == len(config.Tiers)-1 {
+				tier.species = append(tier.species, index)
+				break
+			}
+		}
+	}
+
+	total := 0
+	for _, tier := range config.Tiers {
+		if tier.Weight < 0 {
+			return nil, fmt.Errorf("tier %s has a negative weight", tier.Name)
+		}
+		if len(tier.species) > 0 {
+			total += tier.Weight
+		}
+		log.Printf("Rarity tier %s: %d species, weight %d", tier.Name, len(tier.species), tier.Weight)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no rarity tier with species has a positive weight")
+	}
+	return config, nil
+}
+
+// rarityScore rates how rare a species should be from its base stat total or EXP yield
+func rarityScore(p Pokemon, by string) int {
+	if by == "exp" {
+		exp, _ := strconv.Atoi(p.Exp)
+		return exp
+	}
+	total := 0
+	for _, value := range p.Stats {
+		stat, _ := strconv.Atoi(value)
+		total += stat
+	}
+	return total
+}
+
+// pickSpecies rolls a rarity tier by weight, then a species from that tier, favoring types that suit the terrain
+func pickSpecies(tile rune) (Pokemon, string) {
+	total := 0
+	for _, tier := range spawns.Tiers {
+		if len(tier.species) > 0 {
+			total += tier.Weight
+		}
+	}
+	roll := rng.Intn(total)
+	chosen := spawns.Tiers[0]
+	for _, tier := range spawns.Tiers {
+		if len(tier.species) == 0 {
+			continue
+		}
+		chosen = tier
+		if roll < tier.Weight {
+			break
+		}
+		roll -= tier.Weight
+	}
+	weights := make([]int, len(chosen.species))
+	sum := 0
+	for i, index := range chosen.species {
+		weights[i] = 1
+		for _, t := range terrainTypes[tile] {
+			if hasType(pokemons[index], t) {
+				weights[i] = terrainBonus
+				break
+			}
+		}
+		sum += weights[i]
+	}
+	roll = rng.Intn(sum)
+	for i, weight := range weights {
+		if roll < weight {
+			return pokemons[chosen.species[i]], chosen.Name
+		}
+		roll -= weight
+	}
+	return pokemons[chosen.species[len(chosen.species)-1]], chosen.Name
+}
+
+// place puts a trainer at a position, possibly in another area, and sends them a fresh view of it
+func (w *World) place(s *Session, area string, x, y int, notification string) {
+	s.Area, s.X, s.Y = area, x, y
+	state := w.state(s)
+	state.Notification = notification
+	s.queue(state)
+	w.broadcast(s, WorldDelta{Type: "delta", Trainers: []Trainer{s.trainer()}}, "")
+}
+
+// loadWorldMap reads the areas of the world and checks that every row, warp and the start position fit
+func loadWorldMap(filename string) error {
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to load map file: %v", err)
+	}
+	loaded := &WorldMap{}
+	if err := json.Unmarshal(file, loaded); err != nil {
+		return fmt.Errorf("failed to parse map file: %v", err)
+	}
+	if len(loaded.Areas) == 0 {
+		return fmt.Errorf("the map has no areas")
+	}
+
+	for _, area := range loaded.Areas {
+		if _, exists := areas[area.Name]; exists || area.Name == "" {
+			return fmt.Errorf("area names must be unique and non-empty, got %q", area.Name)
+		}
+		if len(area.Tiles) == 0 || len(area.Tiles[0]) == 0 {
+			return fmt.Errorf("area %s has no tiles", area.Name)
+		}
+		area.Height, area.Width = len(area.Tiles), len(area.Tiles[0])
+		for y, row := range area.Tiles {
+			if len(row) != area.Width {
+				return fmt.Errorf("area %s: row %d is %d tiles wide, expected %d", area.Name, y, len(row), area.Width)
+			}
+			for x, tile := range row {
+				if !strings.ContainsRune(".~:_#O", tile) {
+					return fmt.Errorf("area %s: unknown tile %q at (%d, %d)", area.Name, tile, x, y)
+				}
+			}
+		}
+		areas[area.Name] = area
+		if area.Title == "" {
+			area.Title = area.Name
+		}
+		if len(area.Levels) != 0 && (len(area.Levels) != 2 || area.Levels[0] < 1 || area.Levels[0] > area.Levels[1] || area.Levels[1] > maxLevel) {
+			return fmt.Errorf("area %s: levels must be a lowest and highest level between 1 and %d", area.Name, maxLevel)
+		}
+	}
+
+	for _, area := range loaded.Areas {
+		for _, warp := range area.Warps {
+			if !area.contains(warp.X, warp.Y) || area.tileAt(warp.X, warp.Y) != TileWarp {
+				return fmt.Errorf("area %s: warp at (%d, %d) is not on a warp tile", area.Name, warp.X, warp.Y)
+			}
+			destination, ok := areas[warp.To]
+			if !ok || !destination.contains(warp.ToX, warp.ToY) || destination.tileAt(warp.ToX, warp.ToY) == TileWall {
+				return fmt.Errorf("area %s: warp at (%d, %d) leads nowhere", area.Name, warp.X, warp.Y)
+			}
+		}
+	}
+
+	start, ok := areas[loaded.Start.Area]
+	if !ok || !start.contains(loaded.Start.X, loaded.Start.Y) || !canSpawnOn(start.tileAt(loaded.Start.X, loaded.Start.Y)) {
+		return fmt.Errorf("the start position must be on open ground in an existing area")
+	}
+
+	worldMap = loaded
+	log.Printf("Loaded %d areas from %s", len(loaded.Areas), filename)
+	return nil
+}
+
+// wildLevel rolls the level of a Pokémon spawning in the area
+func (a *Area) wildLevel() int {
+	if len(a.Levels) != 2 {
+		return DefaultLevel
+	}
+	return a.Levels[0] + rng.Intn(a.Levels[1]-a.Levels[0]+1)
+}
+
+// randomArea picks an area for a spawn, weighted by its size
+func randomArea() *Area {
+	total := 0
+	for _, area := range worldMap.Areas {
+		total += area.Width * area.Height
+	}
+	roll := rng.Intn(total)
+	for _, area := range worldMap.Areas {
+		if roll < area.Width*area.Height {
+			return area
+		}
+		roll -= area.Width * area.Height
+	}
+	return worldMap.Areas[0]
+}
+
+// canSpawnOn reports whether wild Pokémon may appear on a tile
+func canSpawnOn(tile rune) bool {
+	return tile != TileWall && tile != TileWarp
+}
+
+// tileAt returns the terrain at a position in the area
+func (a *Area) tileAt(x, y int) rune {
+	return rune(a.Tiles[y][x])
+}
+
+// contains reports whether a position is inside the area
+func (a *Area) contains(x, y int) bool {
+	return x >= 0 && x < a.Width && y >= 0 && y < a.Height
+}
+
+// warpAt returns the warp on a position, if any
+func (a *Area) warpAt(x, y int) *Warp {
+	for i := range a.Warps {
+		if a.Warps[i].X == x && a.Warps[i].Y == y {
+			return &a.Warps[i]
+		}
+	}
+	return nil
+}
+
+// hasType reports whether a Pokémon has the given type
+func hasType(p Pokemon, pokemonType string) bool {
+	for _, t := range p.Types {
+		if t == pokemonType {
+			return true
+		}
+	}
+	return false
+}
+
+// spawnAt returns the wild Pokémon on a cell of an area, if any
+func (w *World) spawnAt(area string, x, y int) *Pokemon {
+	for i := range w.Wild {
+		if w.Wild[i].Area == area && w.Wild[i].X == x && w.Wild[i].Y == y {
+			return &w.Wild[i]
+		}
+	}
+	return nil
+}
+
+// spawnByID returns the wild Pokémon with a spawn ID, if it is still on the map
+func (w *World) spawnByID(spawnID int) *Pokemon {
+	for i := range w.Wild {
+		if w.Wild[i].SpawnID == spawnID {
+			return &w.Wild[i]
+		}
+	}
+	return nil
+}
+
+// findBall looks up a ball by key
+func findBall(key string) (Ball, bool) {
+	for _, ball := range balls {
+		if ball.Key == key {
+			return ball, true
+		}
+	}
+	return Ball{}, false
+}
+
+// catchRate returns a species' catch rate from the pokedex, between 1 (hardest) and 255 (easiest)
+func catchRate(p Pokemon) int {
+	rate, err := strconv.Atoi(p.CatchRate)
+	if err != nil || rate < 1 {
+		return defaultCatchRate
+	}
+	return min(rate, 255)
+}
+
+// catchChance is the probability that a single throw catches a Pokémon, following the main series
+// formula: weakening a Pokémon from full health to 1 HP roughly triples the chance
+func catchChance(rate int, ball Ball, hp, maxHP int) float64 {
+	hp = max(hp, 1)
+	return min(float64(3*maxHP-2*hp)*float64(rate)*ball.Bonus/float64(3*maxHP*255), 1)
+}
+
+// loadRuleset reads the battle rules shared with Pokebat
+func loadRuleset(filename string) (*Ruleset, error) {
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rules file: %v", err)
+	}
+
+	rules := &Ruleset{TeamSize: 3}
+	if err := json.Unmarshal(file, rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file: %v", err)
+	}
+	if rules.TeamSize < 1 {
+		return nil, fmt.Errorf("team_size must be at least 1, got %d", rules.TeamSize)
+	}
+
+	log.Printf("Loaded battle rules from %s: %+v", filename, *rules)
+	return rules, nil
+}
+
+// allowed reports whether a saved Pokémon may battle under the rules
+func (r *Ruleset) allowed(p Pokemon) bool {
+	for _, banned := range r.BannedSpecies {
+		if strings.EqualFold(banned, p.Name) || banned == p.ID {
+			return false
+		}
+	}
+	return r.LevelCap == 0 || r.NormalizeLevel || levelOf(p) <= r.LevelCap
+}
+
+// levelOf returns a Pokémon's level, treating unset levels as DefaultLevel
+func levelOf(p Pokemon) int {
+	if p.Level <= 0 {
+		return DefaultLevel
+	}
+	return p.Level
+}
+
+// SavedPlayer is the part of a player_data.json record Pokecat reads back
+type SavedPlayer struct {
+	PlayerName string              `json:"player_name"`
+	Pokemons   []Pokemon           `json:"pokemons"`
+	Pokedex    map[string]DexEntry `json:"pokedex"`
+	Seen       []string            `json:"seen"` // Species seen, as saved before the Pokédex kept entries
+	Teams      []struct {
+		PokemonIDs []string `json:"pokemon_ids"`
+	} `json:"teams"`
+}
+
+// loadWallet reads a player's saved money and items; players saved before they had any get the starting ones
+func loadWallet(playerName string) (Wallet, error) {
+	record, err := store.Player(players, playerName)
+	if err != nil {
+		return Wallet{}, err
+	}
+	money, inventory, err := shop.WalletOf(record)
+	if err != nil {
+		return Wallet{}, err
+	}
+	return Wallet{Money: money, Inventory: inventory}, nil
+}
+
+// walletView lists the session's money and items for the client, in the order of the shop's prices
+func (s *Session) walletView() *WalletView {
+	view := &WalletView{Money: s.Wallet.Money, Bag: []BagItem{}}
+	for key, count := range s.Wallet.Inventory {
+		if count > 0 {
+			item := shop.Items[key]
+			view.Bag = append(view.Bag, BagItem{Key: key, Name: item.Name, Kind: item.Kind, Count: count})
+		}
+	}
+	sort.Slice(view.Bag, func(i, j int) bool {
+		a, b := view.Bag[i], view.Bag[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return shop.Items[a.Key].Price < shop.Items[b.Key].Price
+	})
+	return view
+}
+
+// takeItem is a wallet change that takes one of an item out of the player's saved inventory
+func takeItem(key string) func(wallet *Wallet) error {
+	return func(wallet *Wallet) error {
+		if wallet.Inventory[key] <= 0 {
+			return fmt.Errorf("You have no %ss left. Buy more at the hub's shop.", shop.Items[key].Name)
+		}
+		wallet.Inventory[key]--
+		return nil
+	}
+}
+
+// addMoney is a wallet change that adds money to the player's savings
+func addMoney(amount int) func(wallet *Wallet) error {
+	return func(wallet *Wallet) error {
+		wallet.Money += amount
+		return nil
+	}
+}
+
+// dex is the player's Pokédex, counting species they saw or Pokémon they owned before the Pokédex kept
+// entries as seen or caught
+func (p *SavedPlayer) dex() map[string]DexEntry {
+	entries := make(map[string]DexEntry)
+	for _, id := range p.Seen {
+		entries[id] = DexEntry{}
+	}
+	for id, entry := range p.Pokedex {
+		entries[id] = entry
+	}
+	for _, owned := range p.Pokemons {
+		if entry := entries[owned.ID]; !entry.Caught {
+			entry.Caught = true
+			entries[owned.ID] = entry
+		}
+	}
+	return entries
+}
+
+// loadSavedPlayer reads a player's saved record, returning nil for players who have none yet
+func loadSavedPlayer(playerName string) (*SavedPlayer, error) {
+	record, err := store.Player(players, playerName)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal player data: %v", err)
+	}
+	var saved SavedPlayer
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse player data: %v", err)
+	}
+	return &saved, nil
+}
+
+// loadTeam builds the player's battle team from their saved Pokémon: their first team preset
+// if it still matches what they own, otherwise the first eligible Pokémon up to the team size
+func loadTeam(playerName string) ([]*Fighter, error) {
+	player, err := loadSavedPlayer(playerName)
+	if err != nil || player == nil {
+		return nil, err
+	}
+
+	var chosen []Pokemon
+	if len(player.Teams) > 0 {
+		for _, id := range player.Teams[0].PokemonIDs {
+			for _, p := range player.Pokemons {
+				if instanceID(p) == id && rules.allowed(p) {
+					chosen = append(chosen, p)
+					break
+				}
+			}
+		}
+	}
+	if len(chosen) == 0 {
+		for _, p := range player.Pokemons {
+			if len(chosen) < rules.TeamSize && rules.allowed(p) {
+				chosen = append(chosen, p)
+			}
+		}
+	}
+
+	team := make([]*Fighter, 0, len(chosen))
+	for _, p := range chosen[:min(len(chosen), rules.TeamSize)] {
+		fighter := newFighter(p)
+		fighter.InstanceID = instanceID(p)
+		team = append(team, fighter)
+	}
+	return team, nil
+}
+
+// instanceID identifies one of a player's Pokémon. Records saved before every catch had its own
+// instance ID held one Pokémon per species, so those fall back to the species ID.
+func instanceID(p Pokemon) string {
+	if p.InstanceID != "" {
+		return p.InstanceID
+	}
+	return p.ID
+}
+
+// newFighter turns a Pokémon into its battle state, with stats scaled to its level, or to the level cap
+// when the rules normalize levels
+func newFighter(p Pokemon) *Fighter {
+	level := levelOf(p)
+	if rules.NormalizeLevel {
+		level = rules.LevelCap
+	}
+	stat := func(name string) int {
+		return battleStat(p, name) * level / StatsLevel
+	}
+	hp := max(stat("HP"), 1)
+	return &Fighter{
+		Name:         p.Name,
+		Types:        p.Types,
+		HP:           hp,
+		MaxHP:        hp,
+		Attack:       stat("Attack"),
+		Defense:      stat("Defense"),
+		SpAtk:        stat("Sp Atk"),
+		SpDef:        stat("Sp Def"),
+		Speed:        stat("Speed"),
+		WhenAttacked: p.WhenAttacked,
+	}
+}
+
+// battleStat is a Pokédex stat adjusted by the Pokémon's individual value and nature.
+// Pokémon saved before individual values existed keep their Pokédex stats.
+func battleStat(p Pokemon, name string) int {
+	value, _ := strconv.Atoi(p.Stats[name])
+	value += p.IVs[name] / 2
+	nature := natures[p.Nature]
+	switch name {
+	case nature.Increased:
+		value = int(float64(value) * natureBoost)
+	case nature.Decreased:
+		value = int(float64(value) * natureDrop)
+	}
+	return value
+}
+
+// rollIndividuals picks the individual values and nature of a newly caught Pokémon
+func rollIndividuals() (map[string]int, string) {
+	ivs := make(map[string]int, len(statNames))
+	for _, name := range statNames {
+		ivs[name] = rng.Intn(maxIV + 1)
+	}
+	// Sorted so a seed always rolls the same nature
+	keys := make([]string, 0, len(natures))
+	for key := range natures {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return ivs, keys[rng.Intn(len(keys))]
+}
+
+// hit applies one attack and describes it
+func hit(attacker, defender *Fighter) string {
+	damage, attackType := calculateDamage(attacker, defender, attacker.Types[0])
+	defender.HP = max(defender.HP-damage, 0)
+	return fmt.Sprintf("%s used a %s attack on %s, dealing %d damage.", attacker.Name, attackType, defender.Name, damage)
+}
+
+// calculateDamage uses the same damage rules as Pokebat: 60% normal attacks, 40% special attacks
+func calculateDamage(attacker, defender *Fighter, element string) (int, string) {
+	isSpecial := rng.Intn(100) < 40
+	var damage int
+	attackType := "normal"
+
+	if isSpecial {
+		elementalMultiplier := getElementalMultiplier(element, defender.WhenAttacked)
+		damage = int(float64(attacker.SpAtk)*elementalMultiplier) - defender.SpDef
+		attackType = "special"
+	} else {
+		damage = attacker.Attack - defender.Defense
+	}
+
+	// Ensure damage is not negative
+	if damage < 0 {
+		damage = 0
+	}
+	return damage, attackType
+}
+
+func getElementalMultiplier(element string, multipliers map[string]string) float64 {
+	multiplierStr, exists := multipliers[element]
+	if !exists {
+		return 1.0 // Default multiplier
+	}
+
+	var multiplier float64
+	fmt.Sscanf(multiplierStr, "%fx", &multiplier)
+	return multiplier
+}
+
+// nextHealthy returns the first team member that can still fight, or -1
+func (b *Battle) nextHealthy() int {
+	for i, fighter := range b.Team {
+		if fighter.HP > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// view describes the encounter for the client
+func (b *Battle) view(spawn *Pokemon, wallet Wallet) *Encounter {
+	team := make([]Member, 0, len(b.Team))
+	for _, fighter := range b.Team {
+		team = append(team, Member{Name: fighter.Name, HP: fighter.HP, MaxHP: fighter.MaxHP})
+	}
+	owned := make([]Ball, 0, len(balls))
+	for _, ball := range balls {
+		ball.Count = wallet.Inventory[ball.Key]
+		owned = append(owned, ball)
+	}
+	potions := 0
+	for key, count := range wallet.Inventory {
+		if shop.Items[key].Kind == "potion" {
+			potions += count
+		}
+	}
+	return &Encounter{
+		SpawnID:   spawn.SpawnID,
+		ID:        spawn.ID,
+		Name:      spawn.Name,
+		Level:     levelOf(*spawn),
+		Types:     spawn.Types,
+		Rarity:    spawn.Rarity,
+		CatchRate: catchRate(*spawn),
+		Balls:     owned,
+		Potions:   potions,
+		WildHP:    b.Wild.HP,
+		WildMaxHP: b.Wild.MaxHP,
+		Team:      team,
+		Active:    b.Active,
+	}
+}
+
+// broadcast queues a delta for every session except the one given, adding a notification.
+// Each session only hears about trainers and Pokémon in its own area.
+func (w *World) broadcast(except *Session, delta WorldDelta, notification string) {
+	delta.Notification = notification
+	for _, session := range w.Sessions {
+		if session != except {
+			session.queue(delta.forArea(session.Area))
+		}
+	}
+}
+
+// forArea trims a delta to what a session in the given area can see; trainers who moved elsewhere are reported as left
+func (d WorldDelta) forArea(area string) WorldDelta {
+	trainers, pokemons := d.Trainers, d.Pokemons
+	d.Trainers, d.Pokemons, d.Left = nil, nil, append([]string(nil), d.Left...)
+	for _, trainer := range trainers {
+		if trainer.area == area {
+			d.Trainers = append(d.Trainers, trainer)
+		} else {
+			d.Left = append(d.Left, trainer.Name)
+		}
+	}
+	for _, pokemon := range pokemons {
+		if pokemon.area == area {
+			d.Pokemons = append(d.Pokemons, pokemon)
+		}
+	}
+	return d
+}
+
+// state builds the full world view sent to a session when it joins
+func (w *World) state(s *Session) WorldState {
+	area := areas[s.Area]
+	wild := make([]MapPokemon, 0, len(w.Wild))
+	for _, p := range w.Wild {
+		if p.Area == s.Area {
+			wild = append(wild, mapPokemon(p))
+		}
+	}
+	trainers := make([]Trainer, 0, len(w.Sessions))
+	for _, session := range w.Sessions {
+		if session != s && session.Area == s.Area {
+			trainers = append(trainers, session.trainer())
+		}
+	}
+	return WorldState{
+		Type:     "state",
+		Area:     area.Name,
+		Title:    area.Title,
+		Width:    area.Width,
+		Height:   area.Height,
+		Terrain:  area.Tiles,
+		X:        s.X,
+		Y:        s.Y,
+		Pokemons: wild,
+		Trainers: trainers,
+		Caught:   len(s.Caught),
+		Pokedex:  s.pokedex(),
+		Wallet:   *s.walletView(),
+	}
+}
+
+// pokedex copies the session's Pokédex. Queued messages are encoded without holding mutex, so they
+// must not share the map that moves and catches keep changing.
+func (s *Session) pokedex() map[string]DexEntry {
+	entries := make(map[string]DexEntry, len(s.Pokedex))
+	for id, entry := range s.Pokedex {
+		entries[id] = entry
+	}
+	return entries
+}
+
+// mapPokemon strips a wild Pokémon down to what clients need to draw it
+func mapPokemon(p Pokemon) MapPokemon {
+	return MapPokemon{SpawnID: p.SpawnID, ID: p.ID, Name: p.Name, Rarity: p.Rarity, X: p.X, Y: p.Y, area: p.Area}
+}
+
+// savePlayerData adds newly caught Pokémon to the player's saved record.
+// Every catch is kept as its own instance, so catching a species twice keeps both.
+func savePlayerData(playerName string, pokemons []Pokemon) error {
+	// Prepare the Pokémon data to be added
+	caughtAt := time.Now().UTC().Format(time.RFC3339)
+	var cleanedPokemons []interface{}
+	for _, p := range pokemons {
+		id, err := store.NewInstanceID()
+		if err != nil {
+			return err
+		}
+		cleanedPokemon := map[string]interface{}{
+			"instance_id":   id,
+			"id":            p.ID,
+			"name":          p.Name,
+			"nickname":      "",
+			"caught_at":     caughtAt,
+			"types":         p.Types,
+			"stats":         p.Stats,
+			"exp":           p.Exp,
+			"when_attacked": p.WhenAttacked,
+			"ivs":           p.IVs,
+			"nature":        p.Nature,
+			"level":         levelOf(p),
+		}
+		cleanedPokemons = append(cleanedPokemons, cleanedPokemon)
+	}
+
+	err := store.UpdatePlayer(players, playerName, func(player store.Record) error {
+		if _, err := store.AssignInstanceIDs(player); err != nil {
+			return err
+		}
+		existingPokemons, _ := player["pokemons"].([]interface{})
+		player["pokemons"] = append(existingPokemons, cleanedPokemons...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Saved %d caught Pokémon for %s", len(pokemons), playerName)
+	return nil
+}
+
+// levelUp raises the level of one of a player's saved Pokémon and evolves it if its species evolves at
+// or below the new level. It returns the new level, or 0 if the Pokémon is already at the level cap or
+// maxLevel, and the species it evolved into, if any.
+func levelUp(playerName, id string) (int, *Pokemon, error) {
+	level := 0
+	var evolved *Pokemon
+	err := store.UpdatePlayer(players, playerName, func(player store.Record) error {
+		var pokemon map[string]interface{}
+		owned, _ := player["pokemons"].([]interface{})
+		for _, p := range owned {
+			if candidate, ok := p.(map[string]interface{}); ok && recordInstanceID(candidate) == id {
+				pokemon = candidate
+				break
+			}
+		}
+		if pokemon == nil {
+			return fmt.Errorf("%s no longer owns Pokémon %s", playerName, id)
+		}
+
+		from, leveled := DefaultLevel, false
+		if saved, ok := pokemon["level"].(float64); ok && saved > 0 {
+			from, leveled = int(saved), true
+		}
+		highest := maxLevel
+		if rules.LevelCap > 0 {
+			highest = min(highest, rules.LevelCap)
+		}
+		if from >= highest {
+			return nil
+		}
+		level = from + 1
+		pokemon["level"] = level
+
+		// A Pokémon saved without a level is only assumed to be at DefaultLevel, so it evolves when it
+		// passes its evolution level rather than on its first level up
+		if species := speciesByID(fmt.Sprint(pokemon["id"])); species != nil {
+			for _, evolution := range species.Evolutions {
+				if evolution.Trigger == "level" && level >= evolution.Level && (leveled || from < evolution.Level) {
+					evolved = speciesByID(evolution.To)
+					break
+				}
+			}
+		}
+		if evolved != nil {
+			evolveRecord(pokemon, *evolved)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return level, evolved, nil
+}
+
+// evolveRecord turns a saved Pokémon into another species. Its instance ID, nickname, level,
+// individual values, nature and held item stay with it.
+func evolveRecord(pokemon map[string]interface{}, species Pokemon) {
+	pokemon["id"] = species.ID
+	pokemon["name"] = species.Name
+	pokemon["types"] = species.Types
+	pokemon["stats"] = species.Stats
+	pokemon["exp"] = species.Exp
+	pokemon["when_attacked"] = species.WhenAttacked
+}
+
+// speciesByID looks up a Pokédex entry
+func speciesByID(id string) *Pokemon {
+	for i := range pokemons {
+		if pokemons[i].ID == id {
+			return &pokemons[i]
+		}
+	}
+	return nil
+}
+
+// recordInstanceID is instanceID for a Pokémon in a raw player_data.json record
+func recordInstanceID(pokemon map[string]interface{}) string {
+	if id, ok := pokemon["instance_id"].(string); ok && id != "" {
+		return id
+	}
+	return fmt.Sprint(pokemon["id"])
+}
+
+// savePokedex merges a player's Pokédex entries into their saved record and updates its completion.
+// Entries are merged one by one rather than replacing the saved Pokédex, so species the hub recorded
+// in the meantime, such as evolutions from items or trades, are kept.
+func savePokedex(playerName string, entries map[string]DexEntry) error {
+	return store.UpdatePlayer(players, playerName, func(player store.Record) error {
+		var saved map[string]DexEntry
+		data, _ := json.Marshal(player["pokedex"])
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("failed to parse Pokédex of %s: %v", playerName, err)
+		}
+		if saved == nil {
+			saved = make(map[string]DexEntry)
+		}
+		for id, entry := range entries {
+			saved[id] = mergeDexEntry(saved[id], entry)
+		}
+		player["pokedex"] = saved
+		player["pokedex_completion"] = completion(saved)
+		return nil
+	})
+}
+
+// mergeDexEntry combines two records of the same species, keeping the earliest times
+func mergeDexEntry(a, b DexEntry) DexEntry {
+	return DexEntry{
+		Caught:      a.Caught || b.Caught,
+		FirstSeen:   earliest(a.FirstSeen, b.FirstSeen),
+		FirstCaught: earliest(a.FirstCaught, b.FirstCaught),
+	}
+}
+
+// earliest returns the earlier of two RFC 3339 UTC times, ignoring empty ones
+func earliest(a, b string) string {
+	if a == "" || (b != "" && b < a) {
+		return b
+	}
+	return a
+}
+
+// updateWallet changes a player's saved money and items, reading them afresh so purchases made at the hub
+// in the meantime are kept, and returns what was saved. An error from change saves nothing.
+func updateWallet(playerName string, change func(wallet *Wallet) error) (Wallet, error) {
+	var wallet Wallet
+	err := store.UpdatePlayer(players, playerName, func(player store.Record) error {
+		money, inventory, err := shop.WalletOf(player)
+		if err != nil {
+			return fmt.Errorf("failed to parse wallet of %s: %v", playerName, err)
+		}
+		wallet = Wallet{Money: money, Inventory: inventory}
+		if err := change(&wallet); err != nil {
+			return err
+		}
+		player["money"] = wallet.Money
+		player["inventory"] = wallet.Inventory
+		return nil
+	})
+	if err != nil {
+		return Wallet{}, err
+	}
+	return wallet, nil
+}
+
+// completion counts how much of the Pokédex a player has seen and caught
+func completion(entries map[string]DexEntry) DexCompletion {
+	result := DexCompletion{Total: len(pokemons)}
+	for _, p := range pokemons {
+		entry, seen := entries[p.ID]
+		if seen {
+			result.Seen++
+		}
+		if entry.Caught {
+			result.Caught++
+		}
+	}
+	if result.Total > 0 {
+		result.SeenPercent = math.Round(1000*float64(result.Seen)/float64(result.Total)) / 10
+		result.CaughtPercent = math.Round(1000*float64(result.Caught)/float64(result.Total)) / 10
+	}
+	return result
+}
+
+// authenticatePlayer authenticates the player using the provided credentials
+func authenticatePlayer(conn net.Conn) (string, bool) {
+	buffer := make([]byte, 2048)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		log.Printf("Failed to read authentication data: %v", err)
+		return "", false
+	}
+
+	var authData map[string]string
+	if err := json.Unmarshal(buffer[:n], &authData); err != nil {
+		log.Printf("Failed to parse authentication data: %v", err)
+		return "", false
+	}
+
+	ok, err := accounts.Login(authData["name"], authData["password"])
+	if err != nil {
+		log.Printf("Failed to check account: %v", err)
+		return "", false
+	}
+	if ok {
+		response := map[string]string{"status": "success"}
+		responseBytes, _ := json.Marshal(response)
+		conn.Write(append(responseBytes, '\n'))
+		return authData["name"], true
+	}
+
+	log.Println("Authentication failed. Exiting.")
+	response := map[string]string{"status": "failure"}
+	responseBytes, _ := json.Marshal(response)
+	conn.Write(append(responseBytes, '\n'))
+	return "", false
 }
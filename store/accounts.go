@@ -0,0 +1,72 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Account is a registered player, as listed in accounts.json
+type Account struct {
+	Name     string `json:"Name"`
+	Password string `json:"Password"`
+}
+
+// Accounts checks usernames and passwords when players log in
+type Accounts interface {
+	// Login reports whether name and password belong to a registered account
+	Login(name, password string) (bool, error)
+	// Exists reports whether name is registered
+	Exists(name string) (bool, error)
+}
+
+// AccountFile keeps accounts in a JSON file such as accounts.json, which is read in full on every check
+type AccountFile struct {
+	path string
+}
+
+// OpenAccounts returns the accounts listed in the file at path
+func OpenAccounts(path string) *AccountFile {
+	return &AccountFile{path: path}
+}
+
+// List returns every account in the file
+func (a *AccountFile) List() ([]Account, error) {
+	file, err := os.ReadFile(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load accounts data file: %v", err)
+	}
+	var accounts []Account
+	if err := json.Unmarshal(file, &accounts); err != nil {
+		return nil, fmt.Errorf("failed to parse accounts data: %v", err)
+	}
+	return accounts, nil
+}
+
+// Login looks for a matching account in the file
+func (a *AccountFile) Login(name, password string) (bool, error) {
+	accounts, err := a.List()
+	if err != nil {
+		return false, err
+	}
+	for _, account := range accounts {
+		if account.Name == name && account.Password == password {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Exists looks for the name in the file
+func (a *AccountFile) Exists(name string) (bool, error) {
+	accounts, err := a.List()
+	if err != nil {
+		return false, err
+	}
+	for _, account := range accounts {
+		if account.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,207 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How long to wait for another process's lock, how often to retry it, and the age after which a lock
+// is assumed to be left over from a crash. Variables so tests can shorten them.
+var (
+	lockTimeout    = 10 * time.Second
+	lockRetryEvery = 50 * time.Millisecond
+	staleLockAge   = 30 * time.Second
+)
+
+// FileStore keeps every record in one JSON file such as player_data.json. Updates hold a lock file next
+// to it that every process using the file shares, and replace the file through a temporary one, so a
+// crash part way through a save leaves the previous version in place.
+type FileStore struct {
+	path  string
+	mutex sync.Mutex // Serializes updates within this process; the lock file serializes processes
+}
+
+// OpenFile returns a store kept in the file at path. The file is created by the first update.
+func OpenFile(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load reads every record; a missing file holds none. Saves replace the file in one step, so reading
+// does not need the lock.
+func (f *FileStore) Load() ([]Record, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read player data: %v", err)
+	}
+	var records []Record
+	if err := decode(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Update applies a change under the lock and saves the result
+func (f *FileStore) Update(change func(records []Record) ([]Record, error)) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	unlock, err := LockFile(f.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	records, err := f.Load()
+	if err != nil {
+		return err
+	}
+	if records, err = change(records); err != nil {
+		return err
+	}
+	data, err := encode(records)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(f.path, data)
+}
+
+// DataPath returns the path of a data file shared by the hub, Pokecat and Pokebat, such as
+// player_data.json. Those live in the project root: the nearest directory holding go.mod above the
+// working directory or, failing that, above the running program. If neither has one, name is
+// returned as it is.
+func DataPath(name string) string {
+	var starts []string
+	if dir, err := os.Getwd(); err == nil {
+		starts = append(starts, dir)
+	}
+	if program, err := os.Executable(); err == nil {
+		starts = append(starts, filepath.Dir(program))
+	}
+	for _, dir := range starts {
+		for {
+			if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+				return filepath.Join(dir, name)
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	return name
+}
+
+// RequireFiles checks that files exist, so a mistyped path stops a program at startup instead of
+// leaving it with no accounts or an empty store
+func RequireFiles(paths ...string) error {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("failed to find %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// LockFile takes the lock shared by every process writing a file: a filename+".lock" file that only one
+// of them can create at a time. It waits up to lockTimeout and breaks locks left behind by a crash.
+// The returned function releases the lock.
+func LockFile(filename string) (func(), error) {
+	lockName := filename + ".lock"
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("failed to generate lock token: %v", err)
+	}
+	// The token identifies this holder, so a holder whose lock was broken as stale does not remove the
+	// lock of whoever took it over
+	id := hex.EncodeToString(random)
+	token := fmt.Sprintf("%d %s\n", os.Getpid(), id)
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		lock, err := os.OpenFile(lockName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = lock.WriteString(token)
+			if closeErr := lock.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockName)
+				return nil, fmt.Errorf("failed to lock %s: %v", filename, err)
+			}
+			return func() {
+				if held, err := os.ReadFile(lockName); err == nil && string(held) == token {
+					os.Remove(lockName)
+				} else {
+					log.Printf("Lock %s was taken over by another process", lockName)
+				}
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to lock %s: %v", filename, err)
+		}
+		if info, err := os.Stat(lockName); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			breakStaleLock(lockName, lockName+".broken."+id)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", lockName)
+		}
+		time.Sleep(lockRetryEvery)
+	}
+}
+
+// breakStaleLock removes a lock left behind by a crash. Several processes can find the same lock stale,
+// so it is first renamed to a name only this one uses: only one of them gets it, and the lock is checked
+// again there. If another process broke it and took a fresh lock in the meantime, that one was renamed
+// instead and is put back.
+func breakStaleLock(lockName, broken string) {
+	if err := os.Rename(lockName, broken); err != nil {
+		return // Released or broken by someone else first
+	}
+	defer os.Remove(broken)
+	if info, err := os.Stat(broken); err == nil && time.Since(info.ModTime()) > staleLockAge {
+		log.Printf("Broke stale lock %s", lockName)
+		return
+	}
+	if err := os.Link(broken, lockName); err != nil {
+		log.Printf("Failed to put back lock %s after breaking it by mistake: %v", lockName, err)
+	}
+}
+
+// WriteFileAtomic replaces a file by writing and syncing a temporary file next to it, then renaming it
+// into place, so readers and a restart after a crash see either the old or the new contents, never half
+func WriteFileAtomic(filename string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	if err := os.Rename(temp.Name(), filename); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", filename, err)
+	}
+	// Make the rename itself survive a crash
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
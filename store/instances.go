@@ -0,0 +1,56 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// NewInstanceID makes a random ID for a caught Pokémon, unique across every player so Pokémon can change hands
+func NewInstanceID() (string, error) {
+	buffer := make([]byte, 8)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", fmt.Errorf("failed to generate instance ID: %v", err)
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+// AssignInstanceIDs gives Pokémon saved before instance IDs existed their own ID, along with the
+// nickname and catch date fields, and points the player's team presets at the new IDs. Until then
+// those Pokémon were known by their species ID, which found the first one of that species, so it
+// returns the new ID of that first one by species ID.
+func AssignInstanceIDs(player Record) (map[string]string, error) {
+	renamed := make(map[string]string)
+	pokemons, _ := player["pokemons"].([]interface{})
+	for _, p := range pokemons {
+		pokemon, ok := p.(map[string]interface{})
+		if !ok || pokemon["instance_id"] != nil {
+			continue
+		}
+		id, err := NewInstanceID()
+		if err != nil {
+			return nil, err
+		}
+		pokemon["instance_id"] = id
+		pokemon["nickname"] = ""
+		pokemon["caught_at"] = "" // Not recorded before instances
+		if _, ok := renamed[fmt.Sprint(pokemon["id"])]; !ok {
+			renamed[fmt.Sprint(pokemon["id"])] = id
+		}
+	}
+
+	teams, _ := player["teams"].([]interface{})
+	for _, t := range teams {
+		team, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ids, _ := team["pokemon_ids"].([]interface{})
+		for i, id := range ids {
+			if instance, ok := renamed[fmt.Sprint(id)]; ok {
+				ids[i] = instance
+			}
+		}
+	}
+	return renamed, nil
+}
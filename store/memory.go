@@ -0,0 +1,50 @@
+package store
+
+import "sync"
+
+// MemoryStore keeps records in memory, for tests. Records are stored encoded, so like a FileStore it
+// hands out copies with the same types a file would produce.
+type MemoryStore struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+// NewMemory returns an in-memory store holding the given records
+func NewMemory(records ...Record) (*MemoryStore, error) {
+	data, err := encode(records)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryStore{data: data}, nil
+}
+
+// Load returns a copy of every record
+func (m *MemoryStore) Load() ([]Record, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var records []Record
+	if err := decode(m.data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Update applies a change while holding the store's mutex and keeps the result
+func (m *MemoryStore) Update(change func(records []Record) ([]Record, error)) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var records []Record
+	if err := decode(m.data, &records); err != nil {
+		return err
+	}
+	records, err := change(records)
+	if err != nil {
+		return err
+	}
+	data, err := encode(records)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
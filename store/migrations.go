@@ -0,0 +1,106 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is one step of the SQL schema. Steps are applied in order and each exactly once, so a
+// released step must never change; add a new one instead.
+type migration struct {
+	name   string
+	schema string
+}
+
+var migrations = []migration{
+	{"accounts and rosters", `
+		CREATE TABLE accounts (
+			name       TEXT PRIMARY KEY,
+			password   TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);
+
+		-- One row per player record; data holds the fields without a column of their own as JSON,
+		-- such as team presets, the Pokédex and items
+		CREATE TABLE players (
+			name  TEXT PRIMARY KEY,
+			money INTEGER,
+			data  TEXT NOT NULL
+		);
+
+		-- Every Pokémon a player owns, in roster order; data is the whole saved Pokémon as JSON
+		CREATE TABLE pokemon (
+			player_name TEXT NOT NULL REFERENCES players(name) ON DELETE CASCADE,
+			position    INTEGER NOT NULL,
+			instance_id TEXT NOT NULL,
+			species_id  TEXT NOT NULL,
+			name        TEXT NOT NULL,
+			nickname    TEXT NOT NULL,
+			level       INTEGER,
+			data        TEXT NOT NULL,
+			PRIMARY KEY (player_name, position)
+		);
+		CREATE INDEX pokemon_by_instance ON pokemon (instance_id);
+		CREATE INDEX pokemon_by_species ON pokemon (species_id);
+	`},
+	{"battles and ratings", `
+		CREATE TABLE battles (
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			winner    TEXT NOT NULL,
+			loser     TEXT NOT NULL,
+			format    TEXT NOT NULL,
+			finished  INTEGER NOT NULL,
+			played_at TEXT NOT NULL
+		);
+		CREATE INDEX battles_by_winner ON battles (winner);
+		CREATE INDEX battles_by_loser ON battles (loser);
+
+		CREATE TABLE ratings (
+			player_name TEXT PRIMARY KEY,
+			rating      INTEGER NOT NULL,
+			wins        INTEGER NOT NULL,
+			losses      INTEGER NOT NULL,
+			updated_at  TEXT NOT NULL
+		);
+	`},
+}
+
+// migrate brings a database's schema up to date. Each step runs in its own transaction together with
+// the row recording it, so a crash part way through leaves the database at the previous step.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %v", err)
+	}
+
+	for i, step := range migrations {
+		version := i + 1
+		err := transact(db, func(tx *sql.Tx) error {
+			var applied int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, version).Scan(&applied); err != nil {
+				return fmt.Errorf("failed to read schema version: %v", err)
+			}
+			if applied > 0 {
+				return nil
+			}
+			if _, err := tx.Exec(step.schema); err != nil {
+				return fmt.Errorf("failed to apply migration %d (%s): %v", version, step.name, err)
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+				version, step.name, time.Now().UTC().Format(time.RFC3339))
+			if err != nil {
+				return fmt.Errorf("failed to record migration %d: %v", version, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
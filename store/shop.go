@@ -0,0 +1,98 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Shop is the item catalog, prices and rewards in shop.json, shared by the hub, Pokecat and Pokebat
+type Shop struct {
+	StartingMoney int                 `json:"starting_money"` // Given to players saved before they had money
+	StartingItems map[string]int      `json:"starting_items"`
+	Rewards       Rewards             `json:"rewards"`
+	Items         map[string]ShopItem `json:"items"`
+}
+
+// Rewards is the money players earn by playing
+type Rewards struct {
+	PokebatWin        int     `json:"pokebat_win"`
+	PokebatLoss       int     `json:"pokebat_loss"`
+	PokecatKnockout   int     `json:"pokecat_knockout"` // For knocking out a wild Pokémon
+	PokecatFind       int     `json:"pokecat_find"`     // Found on the ground while exploring
+	PokecatFindChance float64 `json:"pokecat_find_chance"`
+}
+
+// ShopItem is an item players can buy and own
+type ShopItem struct {
+	Name        string `json:"name"`
+	Kind        string `json:"kind"` // "ball", "potion" or "stone"
+	Price       int    `json:"price"`
+	Heal        int    `json:"heal,omitempty"` // HP a potion restores
+	Description string `json:"description"`
+}
+
+// LoadShop reads the item catalog and rewards, making sure every item in it can be used
+func LoadShop(filename string) (*Shop, error) {
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shop file: %v", err)
+	}
+	shop := &Shop{}
+	if err := json.Unmarshal(file, shop); err != nil {
+		return nil, fmt.Errorf("failed to parse shop file: %v", err)
+	}
+	for key, item := range shop.Items {
+		switch {
+		case item.Kind != "ball" && item.Kind != "potion" && item.Kind != "stone":
+			return nil, fmt.Errorf("item %s has unknown kind %q", key, item.Kind)
+		case item.Price < 1:
+			return nil, fmt.Errorf("item %s must cost at least ₽1", key)
+		case item.Kind == "potion" && item.Heal < 1:
+			return nil, fmt.Errorf("potion %s must heal at least 1 HP", key)
+		}
+	}
+	for key := range shop.StartingItems {
+		if _, ok := shop.Items[key]; !ok {
+			return nil, fmt.Errorf("starting item %s is not in the shop", key)
+		}
+	}
+	if chance := shop.Rewards.PokecatFindChance; chance < 0 || chance > 1 {
+		return nil, fmt.Errorf("pokecat_find_chance must be between 0 and 1, got %v", chance)
+	}
+	return shop, nil
+}
+
+// startingWallet is the money and items a player who has never had any begins with
+func (s *Shop) startingWallet() (int, map[string]int) {
+	inventory := make(map[string]int)
+	for key, count := range s.StartingItems {
+		inventory[key] = count
+	}
+	return s.StartingMoney, inventory
+}
+
+// WalletOf returns a player's saved money and item counts. Players saved before they had any get the
+// starting ones.
+func (s *Shop) WalletOf(record Record) (int, map[string]int, error) {
+	if record["inventory"] == nil {
+		money, inventory := s.startingWallet()
+		return money, inventory, nil
+	}
+	saved := make(map[string]int)
+	data, err := json.Marshal(record["inventory"])
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to marshal inventory: %v", err)
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, nil, fmt.Errorf("failed to parse inventory: %v", err)
+	}
+	// Evolution stones were once keyed with hyphens, such as "fire-stone"
+	inventory := make(map[string]int)
+	for key, count := range saved {
+		inventory[strings.ReplaceAll(key, "-", "_")] += count
+	}
+	money, _ := record["money"].(float64)
+	return int(money), inventory, nil
+}
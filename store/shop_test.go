@@ -0,0 +1,63 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadShopChecksItems(t *testing.T) {
+	shop, err := LoadShop(DataPath("shop.json"))
+	if err != nil {
+		t.Fatalf("LoadShop(shop.json): %v", err)
+	}
+	if len(shop.Items) == 0 {
+		t.Error("shop.json has no items")
+	}
+
+	for name, data := range map[string]string{
+		"unknown kind":          `{"items": {"rock": {"name": "Rock", "kind": "rock", "price": 1}}}`,
+		"free item":             `{"items": {"poke_ball": {"name": "Poké Ball", "kind": "ball"}}}`,
+		"potion that heals 0":   `{"items": {"potion": {"name": "Potion", "kind": "potion", "price": 300}}}`,
+		"missing starting item": `{"starting_items": {"potion": 2}, "items": {}}`,
+		"find chance above 1":   `{"rewards": {"pokecat_find_chance": 2}, "items": {}}`,
+	} {
+		filename := filepath.Join(t.TempDir(), "shop.json")
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		if _, err := LoadShop(filename); err == nil {
+			t.Errorf("LoadShop accepted a shop with a %s", name)
+		}
+	}
+}
+
+func TestWalletOf(t *testing.T) {
+	shop := &Shop{StartingMoney: 3000, StartingItems: map[string]int{"poke_ball": 10}}
+
+	// Players saved before they had items get the starting ones, which they can change without changing the shop
+	money, inventory, err := shop.WalletOf(Record{"player_name": "ash"})
+	if err != nil || money != 3000 || inventory["poke_ball"] != 10 {
+		t.Errorf("WalletOf(new player) = %d, %v, %v", money, inventory, err)
+	}
+	inventory["poke_ball"] = 0
+	if shop.StartingItems["poke_ball"] != 10 {
+		t.Error("changing a starting inventory changed the shop")
+	}
+
+	money, inventory, err = shop.WalletOf(Record{"money": float64(50), "inventory": map[string]interface{}{"potion": float64(2)}})
+	if err != nil || money != 50 || inventory["potion"] != 2 || inventory["poke_ball"] != 0 {
+		t.Errorf("WalletOf(saved player) = %d, %v, %v", money, inventory, err)
+	}
+
+	// Stones saved under their old hyphenated keys count under the current ones
+	_, inventory, err = shop.WalletOf(Record{"inventory": map[string]interface{}{"fire-stone": float64(1), "fire_stone": float64(2)}})
+	if err != nil || inventory["fire_stone"] != 3 || len(inventory) != 1 {
+		t.Errorf("WalletOf(old keys) = %v, %v", inventory, err)
+	}
+
+	if _, _, err := shop.WalletOf(Record{"inventory": "lots"}); err == nil || !strings.Contains(err.Error(), "inventory") {
+		t.Errorf("WalletOf(bad inventory) error = %v", err)
+	}
+}
@@ -0,0 +1,408 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure Go SQLite driver, registered as "sqlite"
+)
+
+// Connection settings: wait for other processes' transactions instead of failing, enforce foreign keys,
+// let readers run alongside a writer, and take the write lock when a transaction begins so two
+// read-then-write updates can never interleave
+const sqlOptions = "?_pragma=busy_timeout(10000)&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_txlock=immediate"
+
+// Rating given to a player before their first battle, and how far one battle can move it
+const (
+	initialRating = 1000
+	ratingFactor  = 32
+)
+
+// SQLStore keeps accounts, players, their Pokémon, battles and ratings in an SQLite database file.
+// It looks up one account or player by key instead of reading everyone, and SQLite's transactions
+// keep updates from separate processes apart and survive crashes.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// Battle is one Pokebat battle, as recorded in the battles table
+type Battle struct {
+	Winner   string
+	Loser    string
+	Format   string
+	Finished bool // False if the loser left part way
+	PlayedAt time.Time
+}
+
+// OpenSQL opens the database at path, creating it if needed, and brings its schema up to date
+func OpenSQL(path string) (*SQLStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+sqlOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// Close closes the database
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// Load reads every player's record
+func (s *SQLStore) Load() ([]Record, error) {
+	return loadRecords(s.db, "")
+}
+
+// Update applies a change in one transaction and saves only the records it changed
+func (s *SQLStore) Update(change func(records []Record) ([]Record, error)) error {
+	return transact(s.db, func(tx *sql.Tx) error {
+		records, err := loadRecords(tx, "")
+		if err != nil {
+			return err
+		}
+		before := make(map[string][]byte)
+		for _, record := range records {
+			if before[recordName(record)], err = json.Marshal(record); err != nil {
+				return fmt.Errorf("failed to marshal player data: %v", err)
+			}
+		}
+
+		if records, err = change(records); err != nil {
+			return err
+		}
+		for _, record := range records {
+			name := recordName(record)
+			data, err := json.Marshal(record)
+			if err != nil {
+				return fmt.Errorf("failed to marshal player data: %v", err)
+			}
+			old, existed := before[name]
+			delete(before, name)
+			if existed && bytes.Equal(old, data) {
+				continue
+			}
+			if err := saveRecord(tx, record); err != nil {
+				return err
+			}
+		}
+		// Whatever is left was dropped by the change
+		for name := range before {
+			if _, err := tx.Exec(`DELETE FROM players WHERE name = ?`, name); err != nil {
+				return fmt.Errorf("failed to delete player %s: %v", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// LoadPlayer reads one player's record, or nil if they have none yet
+func (s *SQLStore) LoadPlayer(name string) (Record, error) {
+	records, err := loadRecords(s.db, name)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+// UpdatePlayer applies a change to one player's record in one transaction, creating an empty record
+// for a player who has none yet
+func (s *SQLStore) UpdatePlayer(name string, change func(record Record) error) error {
+	return transact(s.db, func(tx *sql.Tx) error {
+		records, err := loadRecords(tx, name)
+		if err != nil {
+			return err
+		}
+		player := Record{"player_name": name, "pokemons": []interface{}{}}
+		if len(records) > 0 {
+			player = records[0]
+		}
+		if err := change(player); err != nil {
+			return err
+		}
+		return saveRecord(tx, player)
+	})
+}
+
+// Login looks up the account by name
+func (s *SQLStore) Login(name, password string) (bool, error) {
+	var stored string
+	err := s.db.QueryRow(`SELECT password FROM accounts WHERE name = ?`, name).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up account %s: %v", name, err)
+	}
+	return stored == password, nil
+}
+
+// Exists looks up the account by name
+func (s *SQLStore) Exists(name string) (bool, error) {
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM accounts WHERE name = ?`, name).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to look up account %s: %v", name, err)
+	}
+	return count > 0, nil
+}
+
+// AddAccounts registers accounts in one transaction, replacing the password of any already registered
+func (s *SQLStore) AddAccounts(accounts ...Account) error {
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	return transact(s.db, func(tx *sql.Tx) error {
+		for _, account := range accounts {
+			_, err := tx.Exec(`INSERT INTO accounts (name, password, created_at) VALUES (?, ?, ?)
+				ON CONFLICT (name) DO UPDATE SET password = excluded.password`,
+				account.Name, account.Password, createdAt)
+			if err != nil {
+				return fmt.Errorf("failed to save account %s: %v", account.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Import copies the accounts and players read from the JSON files into the database. Accounts and
+// players in the files replace the ones with the same name, and anyone only in the database is kept.
+func (s *SQLStore) Import(accounts []Account, players []Record) error {
+	if err := s.AddAccounts(accounts...); err != nil {
+		return fmt.Errorf("failed to import accounts: %v", err)
+	}
+	err := s.Update(func(records []Record) ([]Record, error) {
+		index := make(map[string]int)
+		for i, record := range records {
+			index[recordName(record)] = i
+		}
+		for _, record := range players {
+			if i, ok := index[recordName(record)]; ok {
+				records[i] = record
+			} else {
+				records = append(records, record)
+			}
+		}
+		return records, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import players: %v", err)
+	}
+	return nil
+}
+
+// RecordBattle saves a battle and moves both players' Elo ratings by how surprising its result was.
+// It returns the winner's and loser's new ratings.
+func (s *SQLStore) RecordBattle(battle Battle) (int, int, error) {
+	var winnerRating, loserRating int
+	err := transact(s.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO battles (winner, loser, format, finished, played_at) VALUES (?, ?, ?, ?, ?)`,
+			battle.Winner, battle.Loser, battle.Format, battle.Finished, battle.PlayedAt.UTC().Format(time.RFC3339))
+		if err != nil {
+			return fmt.Errorf("failed to save battle: %v", err)
+		}
+		if winnerRating, err = ratingOf(tx, battle.Winner); err != nil {
+			return err
+		}
+		if loserRating, err = ratingOf(tx, battle.Loser); err != nil {
+			return err
+		}
+
+		expected := 1 / (1 + math.Pow(10, float64(loserRating-winnerRating)/400))
+		change := int(math.Round(ratingFactor * (1 - expected)))
+		winnerRating += change
+		loserRating -= change
+
+		updatedAt := time.Now().UTC().Format(time.RFC3339)
+		for _, result := range []struct {
+			name         string
+			rating       int
+			wins, losses int
+		}{{battle.Winner, winnerRating, 1, 0}, {battle.Loser, loserRating, 0, 1}} {
+			_, err := tx.Exec(`INSERT INTO ratings (player_name, rating, wins, losses, updated_at) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (player_name) DO UPDATE SET rating = excluded.rating, wins = wins + excluded.wins,
+				losses = losses + excluded.losses, updated_at = excluded.updated_at`,
+				result.name, result.rating, result.wins, result.losses, updatedAt)
+			if err != nil {
+				return fmt.Errorf("failed to save rating of %s: %v", result.name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return winnerRating, loserRating, nil
+}
+
+// ratingOf returns a player's current rating, or initialRating before their first battle
+func ratingOf(tx *sql.Tx, name string) (int, error) {
+	rating := initialRating
+	err := tx.QueryRow(`SELECT rating FROM ratings WHERE player_name = ?`, name).Scan(&rating)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to read rating of %s: %v", name, err)
+	}
+	return rating, nil
+}
+
+// querier is what loadRecords needs from either the database or a transaction
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadRecords rebuilds player records from the players and pokemon tables: every player's, or only the
+// named player's if name is not empty
+func loadRecords(q querier, name string) ([]Record, error) {
+	filter, args := "", []interface{}{}
+	if name != "" {
+		filter, args = " WHERE name = ?", []interface{}{name}
+	}
+	rows, err := q.Query(`SELECT name, money, data FROM players`+filter+` ORDER BY rowid`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read players: %v", err)
+	}
+	var records []Record
+	byName := make(map[string]Record)
+	for rows.Next() {
+		var playerName, data string
+		var money sql.NullInt64
+		if err := rows.Scan(&playerName, &money, &data); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read players: %v", err)
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to parse data of %s: %v", playerName, err)
+		}
+		if record == nil {
+			record = Record{}
+		}
+		record["player_name"] = playerName
+		record["pokemons"] = []interface{}{}
+		if money.Valid {
+			record["money"] = float64(money.Int64)
+		}
+		records = append(records, record)
+		byName[playerName] = record
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read players: %v", err)
+	}
+
+	if name != "" {
+		filter = " WHERE player_name = ?"
+	}
+	rows, err = q.Query(`SELECT player_name, data FROM pokemon`+filter+` ORDER BY player_name, position`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Pokémon: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var playerName, data string
+		if err := rows.Scan(&playerName, &data); err != nil {
+			return nil, fmt.Errorf("failed to read Pokémon: %v", err)
+		}
+		var pokemon map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &pokemon); err != nil {
+			return nil, fmt.Errorf("failed to parse a Pokémon of %s: %v", playerName, err)
+		}
+		if record := byName[playerName]; record != nil {
+			record["pokemons"] = append(record["pokemons"].([]interface{}), pokemon)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read Pokémon: %v", err)
+	}
+	return records, nil
+}
+
+// saveRecord writes one player's record to the players table and replaces their rows in the pokemon table
+func saveRecord(tx *sql.Tx, record Record) error {
+	// A round trip through JSON gives every number the same type, whichever program set it
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal player data: %v", err)
+	}
+	var player Record
+	if err := json.Unmarshal(data, &player); err != nil {
+		return fmt.Errorf("failed to parse player data: %v", err)
+	}
+	name := recordName(player)
+	pokemons, _ := player["pokemons"].([]interface{})
+	var money sql.NullInt64
+	if amount, ok := player["money"].(float64); ok {
+		money = sql.NullInt64{Int64: int64(amount), Valid: true}
+	}
+	delete(player, "player_name")
+	delete(player, "pokemons")
+	delete(player, "money")
+	if data, err = json.Marshal(player); err != nil {
+		return fmt.Errorf("failed to marshal player data: %v", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO players (name, money, data) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET money = excluded.money, data = excluded.data`, name, money, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to save player %s: %v", name, err)
+	}
+	if _, err := tx.Exec(`DELETE FROM pokemon WHERE player_name = ?`, name); err != nil {
+		return fmt.Errorf("failed to save Pokémon of %s: %v", name, err)
+	}
+	for position, p := range pokemons {
+		pokemon, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(pokemon)
+		if err != nil {
+			return fmt.Errorf("failed to marshal a Pokémon of %s: %v", name, err)
+		}
+		speciesID := fmt.Sprint(pokemon["id"])
+		instanceID, _ := pokemon["instance_id"].(string)
+		if instanceID == "" {
+			// Pokémon saved before instance IDs are known by their species
+			instanceID = speciesID
+		}
+		pokemonName, _ := pokemon["name"].(string)
+		nickname, _ := pokemon["nickname"].(string)
+		var level sql.NullInt64
+		if saved, ok := pokemon["level"].(float64); ok {
+			level = sql.NullInt64{Int64: int64(saved), Valid: true}
+		}
+		_, err = tx.Exec(`INSERT INTO pokemon (player_name, position, instance_id, species_id, name, nickname, level, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			name, position, instanceID, speciesID, pokemonName, nickname, level, string(data))
+		if err != nil {
+			return fmt.Errorf("failed to save Pokémon %s of %s: %v", instanceID, name, err)
+		}
+	}
+	return nil
+}
+
+// recordName is the player a record belongs to
+func recordName(record Record) string {
+	name, _ := record["player_name"].(string)
+	return name
+}
+
+// transact runs do in a transaction, committing if it succeeds and rolling back if it fails
+func transact(db *sql.DB, do func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	if err := do(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestSQL opens a new database in a temporary directory, closed when the test ends
+func openTestSQL(t *testing.T) (*SQLStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pokemon.db")
+	db, err := OpenSQL(path)
+	if err != nil {
+		t.Fatalf("OpenSQL: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, path
+}
+
+func TestMigrationsApplyOnce(t *testing.T) {
+	db, path := openTestSQL(t)
+	db.Close()
+
+	// Opening the database again finds every step applied and runs none twice
+	db, err := OpenSQL(path)
+	if err != nil {
+		t.Fatalf("OpenSQL again: %v", err)
+	}
+	defer db.Close()
+	if err := migrate(db.db); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+	var applied, latest int
+	if err := db.db.QueryRow(`SELECT COUNT(*), MAX(version) FROM schema_migrations`).Scan(&applied, &latest); err != nil {
+		t.Fatalf("reading migrations: %v", err)
+	}
+	if applied != len(migrations) || latest != len(migrations) {
+		t.Errorf("%d migrations recorded up to version %d, want %d", applied, latest, len(migrations))
+	}
+	for _, table := range []string{"accounts", "players", "pokemon", "battles", "ratings"} {
+		var count int
+		if err := db.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&count); err != nil || count != 1 {
+			t.Errorf("table %s missing: %v", table, err)
+		}
+	}
+}
+
+func TestSQLAccounts(t *testing.T) {
+	db, _ := openTestSQL(t)
+	if err := db.AddAccounts(Account{Name: "ash", Password: "pikachu"}, Account{Name: "misty", Password: "starmie"}); err != nil {
+		t.Fatalf("AddAccounts: %v", err)
+	}
+	for _, check := range []struct {
+		name, password string
+		want           bool
+	}{{"ash", "pikachu", true}, {"ash", "starmie", false}, {"brock", "onix", false}} {
+		if ok, err := db.Login(check.name, check.password); err != nil || ok != check.want {
+			t.Errorf("Login(%s, %s) = %v, %v; want %v", check.name, check.password, ok, err, check.want)
+		}
+	}
+	if ok, err := db.Exists("misty"); err != nil || !ok {
+		t.Errorf("Exists(misty) = %v, %v", ok, err)
+	}
+	if ok, err := db.Exists("brock"); err != nil || ok {
+		t.Errorf("Exists(brock) = %v, %v", ok, err)
+	}
+
+	// Adding an account again replaces its password
+	if err := db.AddAccounts(Account{Name: "ash", Password: "raichu"}); err != nil {
+		t.Fatalf("AddAccounts again: %v", err)
+	}
+	if ok, _ := db.Login("ash", "pikachu"); ok {
+		t.Error("old password still works")
+	}
+	if ok, _ := db.Login("ash", "raichu"); !ok {
+		t.Error("new password does not work")
+	}
+}
+
+func TestSQLRosterRoundTrip(t *testing.T) {
+	db, _ := openTestSQL(t)
+	ash := Record{
+		"player_name": "ash",
+		"money":       float64(1200),
+		"inventory":   map[string]interface{}{"poke_ball": float64(3)},
+		"teams":       []interface{}{map[string]interface{}{"name": "Main", "pokemon_ids": []interface{}{"a1", "7"}}},
+		"pokedex":     map[string]interface{}{"25": map[string]interface{}{"caught": true}},
+		"pokemons": []interface{}{
+			map[string]interface{}{"instance_id": "a1", "id": "25", "name": "Pikachu", "nickname": "Sparky", "level": float64(12)},
+			map[string]interface{}{"id": "7", "name": "Squirtle"}, // Saved before instance IDs
+			map[string]interface{}{"instance_id": "a2", "id": "25", "name": "Pikachu", "nickname": ""},
+		},
+	}
+	err := db.Update(func(records []Record) ([]Record, error) {
+		return append(records, ash, Record{"player_name": "misty", "pokemons": []interface{}{}}), nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	got, err := Player(db, "ash")
+	if err != nil {
+		t.Fatalf("Player: %v", err)
+	}
+	want, _ := json.Marshal(ash)
+	if saved, _ := json.Marshal(got); string(saved) != string(want) {
+		t.Errorf("round trip changed the record:\n got %s\nwant %s", saved, want)
+	}
+
+	// Each Pokémon has its own row, in roster order
+	rows, err := db.db.Query(`SELECT position, instance_id, species_id, nickname, level FROM pokemon WHERE player_name = 'ash' ORDER BY position`)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	defer rows.Close()
+	var instances []string
+	for rows.Next() {
+		var position int
+		var instance, species, nickname string
+		var level *int
+		if err := rows.Scan(&position, &instance, &species, &nickname, &level); err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		instances = append(instances, instance)
+		if position == 0 && (species != "25" || nickname != "Sparky" || level == nil || *level != 12) {
+			t.Errorf("first row = %s %s %v, want Pikachu Sparky at level 12", species, nickname, level)
+		}
+	}
+	if len(instances) != 3 || instances[0] != "a1" || instances[1] != "7" || instances[2] != "a2" {
+		t.Errorf("rows = %v, want a1, 7 and a2", instances)
+	}
+
+	// A change to one player leaves the others alone, and a player the change drops is deleted
+	if err := UpdatePlayer(db, "ash", func(record Record) error {
+		record["pokemons"] = record["pokemons"].([]interface{})[:1]
+		return nil
+	}); err != nil {
+		t.Fatalf("UpdatePlayer: %v", err)
+	}
+	err = db.Update(func(records []Record) ([]Record, error) {
+		var kept []Record
+		for _, record := range records {
+			if record["player_name"] != "misty" {
+				kept = append(kept, record)
+			}
+		}
+		return kept, nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	records, err := db.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(records) != 1 || len(records[0]["pokemons"].([]interface{})) != 1 {
+		t.Errorf("records after changes = %v, want ash with one Pokémon", records)
+	}
+	var left int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM pokemon`).Scan(&left); err != nil || left != 1 {
+		t.Errorf("%d Pokémon rows left, want 1: %v", left, err)
+	}
+}
+
+func TestRecordBattleMovesElo(t *testing.T) {
+	db, _ := openTestSQL(t)
+	battle := Battle{Winner: "ash", Loser: "gary", Format: "singles", Finished: true, PlayedAt: time.Now()}
+
+	// Evenly rated players trade half the factor; a favourite then gains less for winning again
+	for _, want := range [][2]int{{1016, 984}, {1031, 969}} {
+		winner, loser, err := db.RecordBattle(battle)
+		if err != nil {
+			t.Fatalf("RecordBattle: %v", err)
+		}
+		if winner != want[0] || loser != want[1] {
+			t.Errorf("ratings = %d and %d, want %d and %d", winner, loser, want[0], want[1])
+		}
+	}
+	// An upset moves the ratings further
+	winner, loser, err := db.RecordBattle(Battle{Winner: "gary", Loser: "ash", Format: "doubles", PlayedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("RecordBattle: %v", err)
+	}
+	if winner != 969+19 || loser != 1031-19 {
+		t.Errorf("ratings after an upset = %d and %d, want %d and %d", winner, loser, 969+19, 1031-19)
+	}
+
+	var wins, losses, battles int
+	if err := db.db.QueryRow(`SELECT wins, losses FROM ratings WHERE player_name = 'ash'`).Scan(&wins, &losses); err != nil {
+		t.Fatalf("reading ratings: %v", err)
+	}
+	if wins != 2 || losses != 1 {
+		t.Errorf("ash has %d wins and %d losses, want 2 and 1", wins, losses)
+	}
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM battles WHERE finished = 0`).Scan(&battles); err != nil || battles != 1 {
+		t.Errorf("%d unfinished battles recorded, want 1: %v", battles, err)
+	}
+}
+
+func TestImportJSONFiles(t *testing.T) {
+	dir := t.TempDir()
+	accountsFile, playersFile := filepath.Join(dir, "accounts.json"), filepath.Join(dir, "player_data.json")
+	files := map[string]string{
+		accountsFile: `[{"Name": "ash", "Password": "pikachu"}, {"Name": "misty", "Password": "starmie"}]`,
+		playersFile: `[
+			{"player_name": "ash", "pokemons": [{"id": "25", "name": "Pikachu", "exp": "112", "stats": {"HP": "35"}, "types": ["electric"]}]},
+			{"player_name": "misty", "money": 500, "pokemons": [{"instance_id": "m1", "id": "120", "name": "Staryu", "nickname": "Star", "level": 18}]}
+		]`,
+	}
+	for filename, data := range files {
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	db, _ := openTestSQL(t)
+	// Someone who signed up after the database was made stays, and an old copy of a file player is replaced
+	if err := db.AddAccounts(Account{Name: "brock", Password: "onix"}); err != nil {
+		t.Fatalf("AddAccounts: %v", err)
+	}
+	if err := db.Update(func([]Record) ([]Record, error) {
+		return []Record{{"player_name": "brock", "pokemons": []interface{}{}}, {"player_name": "ash", "pokemons": []interface{}{}}}, nil
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	accounts, err := OpenAccounts(accountsFile).List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	players, err := OpenFile(playersFile).Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	// Importing twice changes nothing the second time
+	for i := 0; i < 2; i++ {
+		if err := db.Import(accounts, players); err != nil {
+			t.Fatalf("Import: %v", err)
+		}
+	}
+
+	for name, password := range map[string]string{"ash": "pikachu", "misty": "starmie", "brock": "onix"} {
+		if ok, err := db.Login(name, password); err != nil || !ok {
+			t.Errorf("Login(%s) = %v, %v after the import", name, ok, err)
+		}
+	}
+	records, err := db.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("%d players after the import, want 3", len(records))
+	}
+	for _, player := range players {
+		got, err := Player(db, recordName(player))
+		if err != nil {
+			t.Fatalf("Player: %v", err)
+		}
+		want, _ := json.Marshal(player)
+		if saved, _ := json.Marshal(got); string(saved) != string(want) {
+			t.Errorf("imported %s as\n%s\nwant %s", recordName(player), saved, want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Package store keeps every player's saved data: their Pokémon, team presets, Pokédex, money and items.
+// The hub, Pokecat and Pokebat all read and write players through a Store, so changes made by separate
+// processes at the same time are applied one after another instead of overwriting each other.
+//
+// Players and accounts are kept in player_data.json and accounts.json by default, or in an SQLite
+// database opened with OpenSQL, which also records Pokebat battles and ratings.
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Record is one player's saved data, keyed by field name as in player_data.json. Records are kept as
+// plain maps so each program can change the fields it knows about and keep the ones it does not.
+type Record = map[string]interface{}
+
+// Store holds every player's record
+type Store interface {
+	// Load returns a snapshot of every record; changing it does not change the store
+	Load() ([]Record, error)
+	// Update runs change on every record while no one else can update the store, then saves the records
+	// change returns. If change returns an error nothing is saved.
+	Update(change func(records []Record) ([]Record, error)) error
+}
+
+// playerStore is implemented by stores that can read and change one player without loading everyone
+type playerStore interface {
+	LoadPlayer(name string) (Record, error)
+	UpdatePlayer(name string, change func(record Record) error) error
+}
+
+// BattleLog records Pokebat battles and keeps players' ratings
+type BattleLog interface {
+	// RecordBattle saves a battle and returns the winner's and loser's new ratings
+	RecordBattle(battle Battle) (int, int, error)
+}
+
+// Player returns one player's record, or nil if they have none yet
+func Player(s Store, name string) (Record, error) {
+	if players, ok := s.(playerStore); ok {
+		return players.LoadPlayer(name)
+	}
+	records, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record["player_name"] == name {
+			return record, nil
+		}
+	}
+	return nil, nil
+}
+
+// UpdatePlayer runs change on one player's record, creating an empty one for a player who has none yet
+func UpdatePlayer(s Store, name string, change func(record Record) error) error {
+	if players, ok := s.(playerStore); ok {
+		return players.UpdatePlayer(name, change)
+	}
+	return s.Update(func(records []Record) ([]Record, error) {
+		var player Record
+		for _, record := range records {
+			if record["player_name"] == name {
+				player = record
+				break
+			}
+		}
+		if player == nil {
+			player = Record{"player_name": name, "pokemons": []interface{}{}}
+			records = append(records, player)
+		}
+		if err := change(player); err != nil {
+			return nil, err
+		}
+		return records, nil
+	})
+}
+
+// decode and encode are shared by the stores so both hand out the same types, such as float64 numbers
+func decode(data []byte, records *[]Record) error {
+	if len(data) == 0 {
+		*records = nil
+		return nil
+	}
+	if err := json.Unmarshal(data, records); err != nil {
+		return fmt.Errorf("failed to parse player data: %v", err)
+	}
+	return nil
+}
+
+func encode(records []Record) ([]byte, error) {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal player data: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,344 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shortLocks shortens the lock timings for the length of a test
+func shortLocks(t *testing.T) {
+	timeout, retry, stale := lockTimeout, lockRetryEvery, staleLockAge
+	lockTimeout, lockRetryEvery, staleLockAge = 200*time.Millisecond, 10*time.Millisecond, time.Second
+	t.Cleanup(func() {
+		lockTimeout, lockRetryEvery, staleLockAge = timeout, retry, stale
+	})
+}
+
+// addMoney is a read-modify-write change: it reads a player's money and saves it increased by one
+func addMoney(s Store, name string) error {
+	return UpdatePlayer(s, name, func(record Record) error {
+		money, _ := record["money"].(float64)
+		record["money"] = money + 1
+		return nil
+	})
+}
+
+func moneyOf(t *testing.T, s Store, name string) float64 {
+	t.Helper()
+	record, err := Player(s, name)
+	if err != nil {
+		t.Fatalf("Player: %v", err)
+	}
+	if record == nil {
+		t.Fatalf("no record for %s", name)
+	}
+	money, _ := record["money"].(float64)
+	return money
+}
+
+func TestUpdateReadModifyWrite(t *testing.T) {
+	ash := Record{"player_name": "ash", "pokemons": []interface{}{}, "money": 10}
+	memory, err := NewMemory(ash)
+	if err != nil {
+		t.Fatalf("NewMemory: %v", err)
+	}
+	file := OpenFile(filepath.Join(t.TempDir(), "player_data.json"))
+	if err := file.Update(func([]Record) ([]Record, error) { return []Record{ash}, nil }); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	db, _ := openTestSQL(t)
+	if err := db.Update(func([]Record) ([]Record, error) { return []Record{ash}, nil }); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	stores := map[string]Store{"file": file, "memory": memory, "sql": db}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			before := moneyOf(t, s, "ash")
+
+			// Concurrent updates must each see the previous one's result, or some increments are lost
+			const updates = 20
+			var wg sync.WaitGroup
+			for i := 0; i < updates; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := addMoney(s, "ash"); err != nil {
+						t.Errorf("update: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := moneyOf(t, s, "ash"); got != before+updates {
+				t.Errorf("money = %v, want %v", got, before+updates)
+			}
+
+			// A change that fails saves nothing
+			err := s.Update(func(records []Record) ([]Record, error) {
+				records[0]["money"] = -1
+				return nil, errors.New("rejected")
+			})
+			if err == nil {
+				t.Error("failed change returned no error")
+			}
+			if got := moneyOf(t, s, "ash"); got != before+updates {
+				t.Errorf("money after failed change = %v, want %v", got, before+updates)
+			}
+		})
+	}
+}
+
+func TestLoadReturnsCopies(t *testing.T) {
+	s, err := NewMemory(Record{"player_name": "ash", "money": 10})
+	if err != nil {
+		t.Fatalf("NewMemory: %v", err)
+	}
+	records, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	records[0]["money"] = 0
+	if got := moneyOf(t, s, "ash"); got != 10 {
+		t.Errorf("changing a loaded record changed the store: money = %v", got)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	shortLocks(t)
+	filename := filepath.Join(t.TempDir(), "player_data.json")
+	unlock, err := LockFile(filename)
+	if err != nil {
+		t.Fatalf("LockFile: %v", err)
+	}
+	defer unlock()
+
+	start := time.Now()
+	if _, err := LockFile(filename); err == nil {
+		t.Fatal("second LockFile succeeded while the lock was held")
+	} else if !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("second LockFile: %v, want a timeout", err)
+	}
+	if waited := time.Since(start); waited < lockTimeout {
+		t.Errorf("gave up after %v, before the %v timeout", waited, lockTimeout)
+	}
+	if err := OpenFile(filename).Update(func(records []Record) ([]Record, error) { return records, nil }); err == nil {
+		t.Error("Update succeeded while the lock was held")
+	}
+}
+
+func TestStaleLockIsBroken(t *testing.T) {
+	shortLocks(t)
+	filename := filepath.Join(t.TempDir(), "player_data.json")
+	unlockStale, err := LockFile(filename)
+	if err != nil {
+		t.Fatalf("LockFile: %v", err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(filename+".lock", old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	unlock, err := LockFile(filename)
+	if err != nil {
+		t.Fatalf("LockFile with a stale lock: %v", err)
+	}
+	// The holder whose lock was broken must not release the new holder's lock
+	unlockStale()
+	if _, err := os.Stat(filename + ".lock"); err != nil {
+		t.Fatalf("stale holder removed the new lock: %v", err)
+	}
+	unlock()
+	if _, err := os.Stat(filename + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock still there after unlock: %v", err)
+	}
+}
+
+// staleLock leaves a lock behind as a crashed process would
+func staleLock(t *testing.T, filename string) {
+	t.Helper()
+	if err := os.WriteFile(filename+".lock", []byte("1 crashed\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(filename+".lock", old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+}
+
+func TestStaleLockIsBrokenOnce(t *testing.T) {
+	shortLocks(t)
+	lockTimeout = 5 * time.Second
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "player_data.json")
+
+	// A process that found the lock stale only gets round to breaking it after another one already has
+	// and holds a fresh lock; the fresh lock must survive
+	staleLock(t, filename)
+	unlock, err := LockFile(filename)
+	if err != nil {
+		t.Fatalf("LockFile with a stale lock: %v", err)
+	}
+	held, err := os.ReadFile(filename + ".lock")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	breakStaleLock(filename+".lock", filename+".lock.broken.late")
+	if now, err := os.ReadFile(filename + ".lock"); err != nil || string(now) != string(held) {
+		t.Fatalf("late breaker took the fresh lock: %q, %v", now, err)
+	}
+	unlock()
+
+	// Everyone finds the same lock stale at once; still only one of them may hold the lock at a time
+	for round := 0; round < 10; round++ {
+		staleLock(t, filename)
+		var holders, most int
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				unlock, err := LockFile(filename)
+				if err != nil {
+					t.Errorf("LockFile: %v", err)
+					return
+				}
+				mutex.Lock()
+				holders++
+				most = max(most, holders)
+				mutex.Unlock()
+				time.Sleep(2 * time.Millisecond)
+				mutex.Lock()
+				holders--
+				mutex.Unlock()
+				unlock()
+			}()
+		}
+		wg.Wait()
+		if most != 1 {
+			t.Fatalf("round %d: %d processes held the lock at once", round, most)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, entry := range entries {
+		t.Errorf("left behind %s", entry.Name())
+	}
+}
+
+func TestUpdateReplacesFileAtomically(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "player_data.json")
+	s := OpenFile(filename)
+	if err := addMoney(s, "ash"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	before, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	// While a change runs, the file still holds the previous contents
+	err = s.Update(func(records []Record) ([]Record, error) {
+		during, err := os.ReadFile(filename)
+		if err != nil || string(during) != string(before) {
+			t.Errorf("file changed before the update finished: %v", err)
+		}
+		records[0]["money"] = 5
+		return records, nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got := moneyOf(t, s, "ash"); got != 5 {
+		t.Errorf("money = %v, want 5", got)
+	}
+
+	// Only the file itself is left: no temporary files and no lock
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "player_data.json" {
+			t.Errorf("left behind %s", entry.Name())
+		}
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("file mode = %v, want 0644", info.Mode().Perm())
+	}
+}
+
+func TestWriteFileAtomicFailureLeavesTargetAlone(t *testing.T) {
+	dir := t.TempDir()
+	// A non-empty directory in the way makes the rename fail after the temporary file is written
+	target := filepath.Join(dir, "player_data.json")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(target, "keep"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := WriteFileAtomic(target, []byte("new")); err == nil {
+		t.Fatal("WriteFileAtomic over a directory succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(target, "keep")); err != nil {
+		t.Errorf("failed write disturbed the target: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "player_data.json" {
+			t.Errorf("failed write left behind %s", entry.Name())
+		}
+	}
+}
+
+func TestUpdatePlayerCreatesRecord(t *testing.T) {
+	s, err := NewMemory()
+	if err != nil {
+		t.Fatalf("NewMemory: %v", err)
+	}
+	if record, err := Player(s, "misty"); err != nil || record != nil {
+		t.Fatalf("Player before any update = %v, %v; want nil", record, err)
+	}
+	if err := addMoney(s, "misty"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	record, err := Player(s, "misty")
+	if err != nil || record == nil {
+		t.Fatalf("Player = %v, %v", record, err)
+	}
+	if pokemons, ok := record["pokemons"].([]interface{}); !ok || len(pokemons) != 0 {
+		t.Errorf("new record pokemons = %v, want an empty list", record["pokemons"])
+	}
+}
+
+func TestDataPathFindsProjectRoot(t *testing.T) {
+	// Tests run in the package directory, one below the project root
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatalf("Abs: %v", err)
+	}
+	if got, want := DataPath("player_data.json"), filepath.Join(root, "player_data.json"); got != want {
+		t.Errorf("DataPath = %s, want %s", got, want)
+	}
+	if err := RequireFiles(DataPath("go.mod")); err != nil {
+		t.Errorf("RequireFiles(go.mod): %v", err)
+	}
+	if err := RequireFiles(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("RequireFiles accepted a missing file")
+	}
+}